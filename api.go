@@ -0,0 +1,964 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/soundscapecloud/soundscape/internal/archiver"
+	"github.com/soundscapecloud/soundscape/internal/youtube"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	apiVersion = "v1"
+
+	// Page sizes for the list endpoints.
+	apiDefaultLimit = 50
+	apiMaxLimit     = 500
+
+	// Request bodies are small JSON objects.
+	apiMaxBody = 1 << 20
+)
+
+// APIRoute is an endpoint of the JSON API. The route table registers the
+// handlers and generates the OpenAPI spec, so the docs can't drift from the code.
+type APIRoute struct {
+	Method  string
+	Path    string // under /api/v1, e.g. /media/:id
+	Tag     string
+	Summary string
+
+	Scope  string // the token scope it needs; empty is public
+	Query  []APIParam
+	Body   interface{} // an example of the request body, for its schema
+	Result interface{} // an example of the response, or nil for 204 No Content
+	Status int         // the success status, 200 by default
+	Paged  bool        // Result is one item of a paginated list
+
+	Handler httprouter.Handle
+}
+
+type APIParam struct {
+	Name        string
+	Type        string
+	Description string
+}
+
+// cursorParams are the query parameters of the paginated endpoints.
+var cursorParams = []APIParam{
+	{"cursor", "string", "The next_cursor of the previous page."},
+	{"limit", "integer", fmt.Sprintf("Items per page, at most %d (default %d).", apiMaxLimit, apiDefaultLimit)},
+}
+
+func APIRoutes() []APIRoute {
+	return []APIRoute{
+		{Method: "GET", Path: "/openapi.json", Tag: "meta", Summary: "This API's OpenAPI 3 spec.", Result: map[string]interface{}{}, Handler: apiSpec},
+
+		{Method: "GET", Path: "/media", Tag: "media", Summary: "List and search the library, most recently added first.", Scope: ScopeRead,
+			Query:  append([]APIParam{{"q", "string", "Only media whose title, description, author or source contain this."}}, cursorParams...),
+			Result: Media{}, Paged: true, Handler: apiListMedia},
+		{Method: "GET", Path: "/media/:id", Tag: "media", Summary: "Get a media.", Scope: ScopeRead, Result: Media{}, Handler: apiGetMedia},
+		{Method: "PATCH", Path: "/media/:id", Tag: "media", Summary: "Change a media's details; fields that are left out stay the same.", Scope: ScopeImport,
+			Body: APIMediaEdit{}, Result: Media{}, Handler: apiEditMedia},
+		{Method: "POST", Path: "/media/:id/trim", Tag: "media", Summary: "Trim a media's audio (end 0 is the end of the source).", Scope: ScopeImport,
+			Body: APITrim{}, Result: Media{}, Handler: apiTrimMedia},
+		{Method: "DELETE", Path: "/media/:id", Tag: "media", Summary: "Move a media to the trash.", Scope: ScopeImport, Result: APIDeleted{}, Handler: apiDeleteMedia},
+
+		{Method: "GET", Path: "/playlists", Tag: "playlists", Summary: "List the user's and the shared playlists, newest first.", Scope: ScopeRead,
+			Query: cursorParams, Result: List{}, Paged: true, Handler: apiListPlaylists},
+		{Method: "POST", Path: "/playlists", Tag: "playlists", Summary: "Create a playlist.", Scope: ScopePlaylist,
+			Body: APIPlaylistEdit{}, Result: List{}, Status: http.StatusCreated, Handler: apiCreatePlaylist},
+		{Method: "GET", Path: "/playlists/:id", Tag: "playlists", Summary: "Get a playlist with its media.", Scope: ScopeRead, Result: List{}, Handler: apiGetPlaylist},
+		{Method: "PATCH", Path: "/playlists/:id", Tag: "playlists", Summary: "Change a playlist's title or radio shuffle.", Scope: ScopePlaylist,
+			Body: APIPlaylistEdit{}, Result: List{}, Handler: apiEditPlaylist},
+		{Method: "DELETE", Path: "/playlists/:id", Tag: "playlists", Summary: "Move a playlist to the trash.", Scope: ScopePlaylist, Result: APIDeleted{}, Handler: apiDeletePlaylist},
+		{Method: "PUT", Path: "/playlists/:id/order", Tag: "playlists", Summary: "Reorder a playlist; the IDs must be its media, each once.", Scope: ScopePlaylist,
+			Body: APIPlaylistOrder{}, Result: List{}, Handler: apiReorderPlaylist},
+		{Method: "POST", Path: "/playlists/:id/media", Tag: "playlists", Summary: "Add a media to a playlist, at the end unless a position is given.", Scope: ScopePlaylist,
+			Body: APIPlaylistAdd{}, Result: List{}, Handler: apiAddPlaylistMedia},
+		{Method: "DELETE", Path: "/playlists/:id/media/:media", Tag: "playlists", Summary: "Remove a media from a playlist.", Scope: ScopePlaylist, Result: List{}, Handler: apiRemovePlaylistMedia},
+
+		{Method: "GET", Path: "/import", Tag: "import", Summary: "Search YouTube for media to import, leaving out what's already in the library.", Scope: ScopeRead,
+			Query: []APIParam{{"q", "string", "The search terms."}}, Result: []youtube.Video{}, Handler: apiSearchImport},
+		{Method: "GET", Path: "/jobs", Tag: "import", Summary: "The archiver jobs that are running, queued and failed, without other users' private media.", Scope: ScopeRead, Result: APIJobs{}, Handler: apiListJobs},
+		{Method: "POST", Path: "/jobs", Tag: "import", Summary: "Import a YouTube video; this creates the media and queues the job that archives it.", Scope: ScopeImport,
+			Body: APIImport{}, Result: Media{}, Status: http.StatusAccepted, Handler: apiCreateJob},
+		{Method: "DELETE", Path: "/jobs/:id", Tag: "import", Summary: "Cancel a queued or running archiver job, removing the media if it has no audio yet; only the media's owner or an admin can.", Scope: ScopeImport, Handler: apiCancelJob},
+		{Method: "POST", Path: "/jobs/cancel", Tag: "import", Summary: "Cancel every queued and running archiver job; admin only.", Scope: ScopeAdmin, Result: APIJobs{}, Handler: Admin(apiCancelJobs)},
+		{Method: "POST", Path: "/jobs/clear-failed", Tag: "import", Summary: "Forget the failed archiver jobs, removing what they left behind; admin only.", Scope: ScopeAdmin, Result: APIJobs{}, Handler: Admin(apiClearFailedJobs)},
+		{Method: "PUT", Path: "/jobs/:id/position", Tag: "import", Summary: "Move a queued job in the queue, whatever its priority; only the media's owner or an admin can.", Scope: ScopeImport,
+			Body: APIJobPosition{}, Result: APIJobs{}, Handler: apiMoveJob},
+
+		{Method: "GET", Path: "/config", Tag: "config", Summary: "Get the settings.", Scope: ScopeRead, Result: APIConfig{}, Handler: apiGetConfig},
+		{Method: "PATCH", Path: "/config", Tag: "config", Summary: "Change the settings; normalize is admin only, and needs a token with the admin scope.", Scope: ScopeImport,
+			Body: APIConfig{}, Result: APIConfig{}, Handler: apiEditConfig},
+	}
+}
+
+// APIHandle wraps a route's handler like the rest of the app's routes.
+func APIHandle(route APIRoute) httprouter.Handle {
+	if route.Scope == "" {
+		return Log(Auth(route.Handler, true))
+	}
+	return Log(Scope(route.Scope, Auth(route.Handler, false)))
+}
+
+func apiPath(path string) string {
+	return "/api/" + apiVersion + path
+}
+
+// isAPI reports whether the request is for the JSON API, which gets JSON errors.
+func isAPI(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, Prefix(apiPath("/")))
+}
+
+//
+// Requests and responses
+//
+
+type APIError struct {
+	Error struct {
+		Code    string `json:"code"` // e.g. "not_found"
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type APIPage struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"` // empty on the last page
+}
+
+type APIDeleted struct {
+	TrashID string `json:"trash_id,omitempty"` // for restoring it; empty if the trash is disabled
+}
+
+type APIMediaEdit struct {
+	Title       *string `json:"title,omitempty"`
+	Author      *string `json:"author,omitempty"`
+	Album       *string `json:"album,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Private     *bool   `json:"private,omitempty"`
+}
+
+type APITrim struct {
+	Start string `json:"start"` // seconds or a timestamp, e.g. "1:02.5"
+	End   string `json:"end"`
+}
+
+type APIPlaylistEdit struct {
+	Title        *string `json:"title,omitempty"`
+	RadioShuffle *bool   `json:"radio_shuffle,omitempty"`
+}
+
+type APIPlaylistOrder struct {
+	Media []string `json:"media"`
+}
+
+type APIPlaylistAdd struct {
+	Media    string `json:"media"`
+	Position *int   `json:"position,omitempty"` // 0 is the start
+}
+
+type APIImport struct {
+	ID       string `json:"id"`                 // the YouTube video ID
+	Priority string `json:"priority,omitempty"` // "user" (the default), or "subscription" to wait for the others
+}
+
+type APIJobPosition struct {
+	Position int `json:"position"` // 0 starts next
+}
+
+type APIJobs struct {
+	Active []*Media       `json:"active"`
+	Queued []*Media       `json:"queued"` // the next one to start first
+	Failed []APIFailedJob `json:"failed"`
+}
+
+type APIFailedJob struct {
+	Media *Media `json:"media"`
+	Error string `json:"error"`
+}
+
+type APIConfig struct {
+	Volume    *float32 `json:"volume,omitempty"`
+	Normalize *bool    `json:"normalize,omitempty"`
+}
+
+var apiErrorCodes = map[int]string{
+	http.StatusBadRequest:          "bad_request",
+	http.StatusUnauthorized:        "unauthorized",
+	http.StatusForbidden:           "forbidden",
+	http.StatusNotFound:            "not_found",
+	http.StatusConflict:            "conflict",
+	http.StatusInternalServerError: "internal_error",
+	http.StatusBadGateway:          "bad_gateway",
+}
+
+// apiError replies with an error object, e.g. {"error": {"code": "not_found", "message": "media not found"}}.
+func apiError(w http.ResponseWriter, status int, format string, a ...interface{}) {
+	var res APIError
+	res.Error.Code = apiErrorCodes[status]
+	if res.Error.Code == "" {
+		res.Error.Code = strings.Replace(strings.ToLower(http.StatusText(status)), " ", "_", -1)
+	}
+	res.Error.Message = fmt.Sprintf(format, a...)
+	apiJSON(w, status, res)
+}
+
+// apiFail replies with the error from finding or changing something:
+// missing things are 404s, everything else is logged and a 500.
+func apiFail(w http.ResponseWriter, err error) {
+	switch {
+	case err == ErrMediaNotFound || err == ErrListNotFound || err == ErrTrashNotFound:
+		apiError(w, http.StatusNotFound, "%s", err)
+	case os.IsNotExist(err):
+		apiError(w, http.StatusNotFound, "not found")
+	default:
+		logger.Error(err)
+		apiError(w, http.StatusInternalServerError, "internal error, see the server logs")
+	}
+}
+
+func apiJSON(w http.ResponseWriter, status int, data interface{}) {
+	// Empty playlists have no media rather than null media.
+	switch v := data.(type) {
+	case *List:
+		if v.Medias == nil {
+			v.Medias = []*Media{}
+		}
+	case APIPage:
+		if lists, ok := v.Items.([]*List); ok {
+			for _, l := range lists {
+				if l.Medias == nil {
+					l.Medias = []*Media{}
+				}
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(data); err != nil {
+		logger.Error(err)
+	}
+}
+
+// decodeJSON reads the request body into v, replying with a 400 if it can't.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(io.LimitReader(r.Body, apiMaxBody)).Decode(v); err != nil {
+		apiError(w, http.StatusBadRequest, "invalid JSON body: %s", err)
+		return false
+	}
+	return true
+}
+
+// pageKey is an item's place in a paginated list: newest first, then by ID.
+// The cursor is the key of the last item of a page, so items added or removed
+// since the previous page don't shift the next one.
+type pageKey struct {
+	Time time.Time
+	ID   string
+}
+
+// after reports whether k comes after c in the list.
+func (k pageKey) after(c pageKey) bool {
+	if !k.Time.Equal(c.Time) {
+		return k.Time.Before(c.Time)
+	}
+	return k.ID > c.ID
+}
+
+// paginate returns the bounds of the page of n items, sorted by their
+// pageKey, that the request selects, and the cursor of the next page. Cursors are
+// opaque to clients.
+func paginate(w http.ResponseWriter, r *http.Request, n int, key func(i int) pageKey) (begin, end int, next string, ok bool) {
+	limit := apiDefaultLimit
+	if v := r.FormValue("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > apiMaxLimit {
+			apiError(w, http.StatusBadRequest, "limit must be between 1 and %d", apiMaxLimit)
+			return 0, 0, "", false
+		}
+		limit = l
+	}
+	if v := r.FormValue("cursor"); v != "" {
+		cursor, err := parseCursor(v)
+		if err != nil {
+			apiError(w, http.StatusBadRequest, "invalid cursor")
+			return 0, 0, "", false
+		}
+		begin = sort.Search(n, func(i int) bool { return key(i).after(cursor) })
+	}
+	end = begin + limit
+	if end >= n {
+		return begin, n, "", true
+	}
+	last := key(end - 1)
+	return begin, end, base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", last.Time.UnixNano(), last.ID))), true
+}
+
+func parseCursor(s string) (pageKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageKey{}, err
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return pageKey{}, fmt.Errorf("invalid cursor")
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return pageKey{}, err
+	}
+	return pageKey{Time: time.Unix(0, nsec), ID: parts[1]}, nil
+}
+
+//
+// Media
+//
+
+func apiListMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	medias, err := UserMedias(ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	medias = SearchMedias(medias, strings.TrimSpace(r.FormValue("q")))
+	// Created, since editing media changes Modified and would move it past the cursor.
+	mediaKey := func(i int) pageKey { return pageKey{medias[i].Created, medias[i].ID} }
+	sort.Slice(medias, func(i, j int) bool { return mediaKey(j).after(mediaKey(i)) })
+	begin, end, next, ok := paginate(w, r, len(medias), mediaKey)
+	if !ok {
+		return
+	}
+	apiJSON(w, http.StatusOK, APIPage{Items: append([]*Media{}, medias[begin:end]...), NextCursor: next})
+}
+
+func apiGetMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := FindUserMedia(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, media)
+}
+
+// apiEditableMedia finds the media in the request, if the user may change it.
+func apiEditableMedia(w http.ResponseWriter, ps httprouter.Params) (*Media, bool) {
+	media, err := findEditableMedia(append(ps, httprouter.Param{Key: "media", Value: ps.ByName("id")}))
+	if err != nil {
+		apiFail(w, err)
+		return nil, false
+	}
+	return media, true
+}
+
+func apiEditMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, ok := apiEditableMedia(w, ps)
+	if !ok {
+		return
+	}
+	var edit APIMediaEdit
+	if !decodeJSON(w, r, &edit) {
+		return
+	}
+	if edit.Title != nil && strings.TrimSpace(*edit.Title) == "" {
+		apiError(w, http.StatusBadRequest, "the title can't be empty")
+		return
+	}
+
+	var changed []string
+	if edit.Title != nil {
+		media.Title = strings.TrimSpace(*edit.Title)
+		changed = append(changed, "title")
+	}
+	if edit.Author != nil {
+		media.Author = *edit.Author
+		changed = append(changed, "author")
+	}
+	if edit.Album != nil {
+		media.Album = *edit.Album
+		changed = append(changed, "album")
+	}
+	if edit.Description != nil {
+		media.Description = *edit.Description
+		changed = append(changed, "description")
+	}
+	privacy := edit.Private != nil && *edit.Private != media.Private
+	if privacy {
+		media.Private = *edit.Private
+	}
+	media.Modified = time.Now()
+	if err := media.Save(); err != nil {
+		apiFail(w, err)
+		return
+	}
+	if len(changed) > 0 {
+		audit.Record(r, ps, "edit", "media", media.ID, fmt.Sprintf("%s (%s)", media.Title, strings.Join(changed, ", ")))
+	}
+	if privacy {
+		action := "public"
+		if media.Private {
+			action = "private"
+		}
+		audit.Record(r, ps, action, "media", media.ID, media.Title)
+	}
+	apiJSON(w, http.StatusOK, media)
+}
+
+func apiTrimMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, ok := apiEditableMedia(w, ps)
+	if !ok {
+		return
+	}
+	var trim APITrim
+	if !decodeJSON(w, r, &trim) {
+		return
+	}
+	start, err := archiver.ParseTimestamp(trim.Start)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid start: %s", err)
+		return
+	}
+	end, err := archiver.ParseTimestamp(trim.End)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "invalid end: %s", err)
+		return
+	}
+	if err := media.Trim(r.Context(), start, end); err != nil {
+		apiFail(w, err)
+		return
+	}
+	logger.Infof("trimmed media %q from %.2f to %.2f", media.ID, start, end)
+	audit.Record(r, ps, "trim", "media", media.ID, fmt.Sprintf("%s (%.2f to %.2f)", media.Title, start, end))
+	apiJSON(w, http.StatusOK, media)
+}
+
+func apiDeleteMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, ok := apiEditableMedia(w, ps)
+	if !ok {
+		return
+	}
+	trashID, err := DeleteMedia(media.ID, ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	audit.Record(r, ps, "delete", "media", media.ID, media.Title)
+	apiJSON(w, http.StatusOK, APIDeleted{TrashID: trashID})
+}
+
+//
+// Playlists
+//
+
+func apiListPlaylists(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	lists, err := UserLists(ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	listKey := func(i int) pageKey { return pageKey{lists[i].Created, lists[i].ID} }
+	sort.Slice(lists, func(i, j int) bool { return listKey(j).after(listKey(i)) })
+	begin, end, next, ok := paginate(w, r, len(lists), listKey)
+	if !ok {
+		return
+	}
+	apiJSON(w, http.StatusOK, APIPage{Items: append([]*List{}, lists[begin:end]...), NextCursor: next})
+}
+
+func apiGetPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := FindUserList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	apiJSON(w, http.StatusOK, list)
+}
+
+func apiCreatePlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var edit APIPlaylistEdit
+	if !decodeJSON(w, r, &edit) {
+		return
+	}
+	if edit.Title == nil || strings.TrimSpace(*edit.Title) == "" {
+		apiError(w, http.StatusBadRequest, "the playlist needs a title")
+		return
+	}
+	list, err := NewList(strings.TrimSpace(*edit.Title), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	if edit.RadioShuffle != nil {
+		list.RadioShuffle = *edit.RadioShuffle
+		if err := list.Save(); err != nil {
+			apiFail(w, err)
+			return
+		}
+	}
+	audit.Record(r, ps, "create", "list", list.ID, list.Title)
+	apiJSON(w, http.StatusCreated, list)
+}
+
+func apiEditPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	var edit APIPlaylistEdit
+	if !decodeJSON(w, r, &edit) {
+		return
+	}
+	if edit.Title != nil && strings.TrimSpace(*edit.Title) == "" {
+		apiError(w, http.StatusBadRequest, "the title can't be empty")
+		return
+	}
+
+	var changed []string
+	if edit.Title != nil {
+		list.Title = strings.TrimSpace(*edit.Title)
+		changed = append(changed, "title")
+	}
+	if edit.RadioShuffle != nil {
+		list.RadioShuffle = *edit.RadioShuffle
+		changed = append(changed, fmt.Sprintf("radio shuffle %t", list.RadioShuffle))
+	}
+	if err := list.Save(); err != nil {
+		apiFail(w, err)
+		return
+	}
+	if len(changed) > 0 {
+		audit.Record(r, ps, "edit", "list", list.ID, fmt.Sprintf("%s (%s)", list.Title, strings.Join(changed, ", ")))
+	}
+	apiJSON(w, http.StatusOK, list)
+}
+
+func apiDeletePlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	trashID, err := DeleteList(list.ID, ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	audit.Record(r, ps, "delete", "list", list.ID, list.Title)
+	apiJSON(w, http.StatusOK, APIDeleted{TrashID: trashID})
+}
+
+func apiReorderPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	var order APIPlaylistOrder
+	if !decodeJSON(w, r, &order) {
+		return
+	}
+	if err := list.ReorderMedia(order.Media); err == ErrInvalidOrder {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	} else if err != nil {
+		apiFail(w, err)
+		return
+	}
+	audit.Record(r, ps, "reorder", "list", list.ID, list.Title)
+	apiJSON(w, http.StatusOK, list)
+}
+
+func apiAddPlaylistMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	var add APIPlaylistAdd
+	if !decodeJSON(w, r, &add) {
+		return
+	}
+	media, err := FindUserMedia(add.Media, ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	if list.HasMedia(media) {
+		apiError(w, http.StatusConflict, "the playlist already has media %q", media.ID)
+		return
+	}
+	position := len(list.Medias)
+	if add.Position != nil {
+		position = *add.Position
+	}
+	if err := list.InsertMedia(media, position); err != nil {
+		apiFail(w, err)
+		return
+	}
+	audit.Record(r, ps, "add", "list", list.ID, fmt.Sprintf("%s (%s)", media.Title, media.ID))
+	apiJSON(w, http.StatusOK, list)
+}
+
+func apiRemovePlaylistMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	media, err := FindUserMedia(ps.ByName("media"), ps.ByName("user"))
+	if err != nil {
+		apiFail(w, err)
+		return
+	}
+	if !list.HasMedia(media) {
+		apiError(w, http.StatusNotFound, "the playlist doesn't have media %q", media.ID)
+		return
+	}
+	if err := list.RemoveMedia(media); err != nil {
+		apiFail(w, err)
+		return
+	}
+	audit.Record(r, ps, "remove", "list", list.ID, fmt.Sprintf("%s (%s)", media.Title, media.ID))
+	apiJSON(w, http.StatusOK, list)
+}
+
+//
+// Import
+//
+
+func apiSearchImport(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	query := strings.TrimSpace(r.FormValue("q"))
+	if query == "" {
+		apiError(w, http.StatusBadRequest, "q is required")
+		return
+	}
+	youtubes, err := searchImports(query)
+	if err != nil {
+		logger.Errorf("query %q failed: %s", query, err)
+		apiError(w, http.StatusBadGateway, "searching YouTube failed: %s", err)
+		return
+	}
+	if youtubes == nil {
+		youtubes = []youtube.Video{}
+	}
+	apiJSON(w, http.StatusOK, youtubes)
+}
+
+func apiListJobs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := ps.ByName("user")
+	failed := []APIFailedJob{}
+	for _, m := range VisibleMedias(FailedMedias(), user) {
+		job := APIFailedJob{Media: m}
+		if err := archive.JobError(m.ID); err != nil {
+			job.Error = err.Error()
+		}
+		failed = append(failed, job)
+	}
+	apiJSON(w, http.StatusOK, APIJobs{
+		Active: append([]*Media{}, VisibleMedias(ActiveMedias(), user)...),
+		Queued: append([]*Media{}, VisibleMedias(QueuedMedias(), user)...),
+		Failed: failed,
+	})
+}
+
+func apiCreateJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req APIImport
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	if req.ID == "" {
+		apiError(w, http.StatusBadRequest, "id is required")
+		return
+	}
+	priority, err := archiver.ParsePriority(req.Priority)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	if m, err := loadMedia(req.ID); err == nil && (m.HasAudio() || archive.InProgress(m.ID)) {
+		apiError(w, http.StatusConflict, "media %q is already in the library or being saved", m.ID)
+		return
+	}
+	media, err := saveImport(req.ID, ps.ByName("user"), RequestID(r), priority)
+	if err != nil {
+		apiError(w, http.StatusBadGateway, "getting video %q from YouTube failed: %s", req.ID, err)
+		return
+	}
+	audit.Record(r, ps, "save", "job", media.ID, media.Title)
+	apiJSON(w, http.StatusAccepted, media)
+}
+
+func apiMoveJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req APIJobPosition
+	if !decodeJSON(w, r, &req) {
+		return
+	}
+	id := ps.ByName("id")
+	if !mayChangeImport(id, ps.ByName("user")) {
+		apiError(w, http.StatusForbidden, "only the media's owner or an admin can move its job")
+		return
+	}
+	if err := archive.Move(id, req.Position); err != nil {
+		apiError(w, http.StatusNotFound, "no queued job for %q", id)
+		return
+	}
+	audit.Record(r, ps, "reorder", "job", id, fmt.Sprintf("position %d", req.Position))
+	apiListJobs(w, r, ps)
+}
+
+func apiCancelJob(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	if !mayChangeImport(id, ps.ByName("user")) {
+		apiError(w, http.StatusForbidden, "only the media's owner or an admin can cancel its job")
+		return
+	}
+	if !CancelImport(id) {
+		apiError(w, http.StatusNotFound, "no job for %q", id)
+		return
+	}
+	audit.Record(r, ps, "cancel", "job", id, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func apiCancelJobs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	for _, id := range CancelImports() {
+		audit.Record(r, ps, "cancel", "job", id, "")
+	}
+	apiListJobs(w, r, ps)
+}
+
+func apiClearFailedJobs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	for _, id := range ClearFailedImports() {
+		audit.Record(r, ps, "remove", "job", id, "failed")
+	}
+	apiListJobs(w, r, ps)
+}
+
+//
+// Config
+//
+
+func apiConfig() APIConfig {
+	c := config.Get()
+	return APIConfig{Volume: &c.Volume, Normalize: &c.Normalize}
+}
+
+func apiGetConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	apiJSON(w, http.StatusOK, apiConfig())
+}
+
+func apiEditConfig(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var edit APIConfig
+	if !decodeJSON(w, r, &edit) {
+		return
+	}
+	if edit.Volume != nil && (*edit.Volume < 0 || *edit.Volume > 1) {
+		apiError(w, http.StatusBadRequest, "volume must be between 0 and 1")
+		return
+	}
+	if edit.Normalize != nil {
+		if u, err := users.Get(ps.ByName("user")); err != nil || !u.Admin || !tokenAllows(ps, ScopeAdmin) {
+			apiError(w, http.StatusForbidden, "only admins can change normalize")
+			return
+		}
+	}
+	if edit.Volume != nil {
+		if err := config.SetVolume(*edit.Volume); err != nil {
+			apiFail(w, err)
+			return
+		}
+	}
+	if edit.Normalize != nil {
+		if err := config.SetNormalize(*edit.Normalize); err != nil {
+			apiFail(w, err)
+			return
+		}
+		archive.SetNormalize(*edit.Normalize)
+	}
+	apiJSON(w, http.StatusOK, apiConfig())
+}
+
+//
+// OpenAPI
+//
+
+func apiSpec(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	apiJSON(w, http.StatusOK, OpenAPI(r, APIRoutes()))
+}
+
+// OpenAPI builds an OpenAPI 3 spec from the route table, with the schemas
+// taken from the JSON fields of the example bodies and results.
+func OpenAPI(r *http.Request, routes []APIRoute) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	schemaOf(reflect.TypeOf(APIError{}), schemas)
+
+	paths := map[string]map[string]interface{}{}
+	for _, route := range routes {
+		var params []interface{}
+		path := route.Path
+		for _, part := range strings.Split(route.Path, "/") {
+			if !strings.HasPrefix(part, ":") {
+				continue
+			}
+			name := strings.TrimPrefix(part, ":")
+			path = strings.Replace(path, part, "{"+name+"}", 1)
+			params = append(params, map[string]interface{}{
+				"name": name, "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+			})
+		}
+		for _, p := range route.Query {
+			params = append(params, map[string]interface{}{
+				"name": p.Name, "in": "query", "description": p.Description, "schema": map[string]string{"type": p.Type},
+			})
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]interface{}{"description": http.StatusText(status)}
+		if route.Result == nil {
+			status = http.StatusNoContent
+			success["description"] = http.StatusText(status)
+		} else {
+			schema := schemaOf(reflect.TypeOf(route.Result), schemas)
+			if route.Paged {
+				schema = map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"items":       map[string]interface{}{"type": "array", "items": schema},
+						"next_cursor": map[string]interface{}{"type": "string", "description": "Empty on the last page."},
+					},
+				}
+			}
+			success["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+		}
+
+		op := map[string]interface{}{
+			"summary":     route.Summary,
+			"tags":        []string{route.Tag},
+			"operationId": operationID(route),
+			"responses": map[string]interface{}{
+				strconv.Itoa(status): success,
+				"default": map[string]interface{}{
+					"description": "An error.",
+					"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": map[string]string{"$ref": "#/components/schemas/Error"}}},
+				},
+			},
+		}
+		if params != nil {
+			op["parameters"] = params
+		}
+		if route.Body != nil {
+			op["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schemaOf(reflect.TypeOf(route.Body), schemas)}},
+			}
+		}
+		if route.Scope == "" {
+			op["security"] = []interface{}{}
+		} else {
+			op["description"] = fmt.Sprintf("API tokens need the %q scope.", route.Scope)
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(route.Method)] = op
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]string{
+			"title":   "Soundscape API",
+			"version": version,
+		},
+		"servers": []map[string]string{{"url": AbsoluteURL(r, apiPath(""))}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"token": map[string]string{"type": "http", "scheme": "bearer", "description": "A personal API token from the API Tokens page."},
+				"basic": map[string]string{"type": "http", "scheme": "basic"},
+			},
+		},
+		"security": []map[string][]string{{"token": {}}, {"basic": {}}},
+	}
+}
+
+// operationID names an operation after its method and path, e.g. "deletePlaylistsIdMediaMedia".
+func operationID(route APIRoute) string {
+	words := strings.FieldsFunc(route.Path, func(c rune) bool {
+		return c == '/' || c == ':' || c == '.'
+	})
+	return strings.ToLower(route.Method) + strings.Replace(strings.Title(strings.Join(words, " ")), " ", "", -1)
+}
+
+// schemaOf returns the JSON schema of t. Named structs are added to schemas
+// (without the "API" prefix) and referenced.
+func schemaOf(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		name := strings.TrimPrefix(t.Name(), "API")
+		if name == "" {
+			return structSchema(t, schemas)
+		}
+		if _, ok := schemas[name]; !ok {
+			schemas[name] = nil // Recursive types refer to themselves.
+			schemas[name] = structSchema(t, schemas)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Anonymous {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = schemaOf(f.Type, schemas)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
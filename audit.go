@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	AuditTargets = []string{"media", "list", "job", "user", "share", "token", "setting"}
+	AuditActions = []string{"add", "admin", "cancel", "create", "delete", "edit", "password", "private", "public", "purge", "remove", "reorder", "restore", "revoke", "save", "shuffle", "split", "trim", "unadmin"}
+)
+
+// AuditEvent is a change somebody made to the library, a playlist, a job or an account.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Token  string    `json:"token,omitempty"` // API token ID, if one was used
+	IP     string    `json:"ip"`
+	Action string    `json:"action"` // e.g. "delete"
+	Target string    `json:"target"` // one of AuditTargets
+	ID     string    `json:"id"`
+	Detail string    `json:"detail,omitempty"` // e.g. the title, so deleted things stay recognizable
+}
+
+// AuditFilter selects audit events. Empty fields match everything.
+type AuditFilter struct {
+	User   string
+	Action string
+	Target string
+	ID     string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f AuditFilter) Match(e AuditEvent) bool {
+	switch {
+	case f.User != "" && e.User != f.User:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Target != "" && e.Target != f.Target:
+		return false
+	case f.ID != "" && e.ID != f.ID:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// AuditLog is an append-only file with one JSON event per line.
+type AuditLog struct {
+	sync.Mutex
+	filename string
+}
+
+func NewAuditLog(filename string) (*AuditLog, error) {
+	filename = filepath.Join(datadir, filename)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{filename: filename}, f.Close()
+}
+
+// Record appends an event for the request's user. Failures are logged,
+// they don't fail the change that was already made.
+func (a *AuditLog) Record(r *http.Request, ps httprouter.Params, action, target, id, detail string) {
+	e := AuditEvent{
+		Time:   time.Now(),
+		User:   ps.ByName("user"),
+		Token:  ps.ByName("token"),
+		IP:     clientIP(r),
+		Action: action,
+		Target: target,
+		ID:     id,
+		Detail: detail,
+	}
+	if err := a.append(e); err != nil {
+		logger.Errorf("audit: %s %s %q by %q not recorded: %s", action, target, id, e.User, err)
+	}
+}
+
+func (a *AuditLog) append(e AuditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	a.Lock()
+	defer a.Unlock()
+
+	f, err := os.OpenFile(a.filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Query returns the matching events, newest first.
+func (a *AuditLog) Query(filter AuditFilter) ([]AuditEvent, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	f, err := os.Open(a.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var events []AuditEvent
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var e AuditEvent
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			logger.Errorf("audit: skipping bad line: %s", err)
+			continue
+		}
+		if filter.Match(e) {
+			events = append(events, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// The file is oldest first.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
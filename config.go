@@ -15,6 +15,10 @@ type Config struct {
 	// Settings
 	AcceptTOS bool    `json:"accept_tos"`
 	Volume    float32 `json:"volume"`
+	Normalize bool    `json:"normalize"`
+
+	// Flags changed on the settings page
+	Settings map[string]string `json:"settings,omitempty"`
 }
 
 func NewConfig(filename string) (*Config, error) {
@@ -42,9 +46,15 @@ func (c *Config) Get() Config {
 	c.RLock()
 	defer c.RUnlock()
 
+	settings := make(map[string]string, len(c.Settings))
+	for k, v := range c.Settings {
+		settings[k] = v
+	}
 	return Config{
 		Volume:    c.Volume,
 		AcceptTOS: c.AcceptTOS,
+		Normalize: c.Normalize,
+		Settings:  settings,
 	}
 }
 
@@ -62,6 +72,23 @@ func (c *Config) SetVolume(n float32) error {
 	return c.Save()
 }
 
+func (c *Config) SetNormalize(v bool) error {
+	c.Lock()
+	c.Normalize = v
+	c.Unlock()
+	return c.Save()
+}
+
+func (c *Config) SetSetting(name, value string) error {
+	c.Lock()
+	if c.Settings == nil {
+		c.Settings = make(map[string]string)
+	}
+	c.Settings[name] = value
+	c.Unlock()
+	return c.Save()
+}
+
 func (c *Config) Save() error {
 	c.RLock()
 	defer c.RUnlock()
@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/http"
@@ -10,11 +13,16 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/soundscapecloud/soundscape/internal/archiver"
+	"github.com/soundscapecloud/soundscape/internal/hls"
+	"github.com/soundscapecloud/soundscape/internal/oidc"
+	"github.com/soundscapecloud/soundscape/internal/radio"
 	"github.com/soundscapecloud/soundscape/internal/youtube"
 
 	"github.com/disintegration/imaging"
+	humanize "github.com/dustin/go-humanize"
 	"github.com/eduncan911/podcast"
 	"github.com/julienschmidt/httprouter"
 	"github.com/rylio/ytdl"
@@ -32,8 +40,16 @@ type Response struct {
 
 	Error   string
 	User    string
+	Account User
+	Admin   bool
+	Login   bool
+	SSO     bool
 	Section string
 
+	// Security
+	CSRF  string
+	Nonce string
+
 	// Paging
 	Page       int64
 	Pages      []int64
@@ -51,8 +67,32 @@ type Response struct {
 
 	ActiveMedias []*Media
 	QueuedMedias []*Media
+	FailedMedias []*Media
 
 	Youtubes []youtube.Video
+
+	Users []User
+
+	Share  *Share
+	Shares []Share
+	Key    string
+
+	Tokens   []Token
+	Scopes   []string
+	NewToken string
+
+	Trash          []TrashItem
+	TrashRetention string
+
+	AuditEvents  []AuditEvent
+	AuditActions []string
+	AuditTargets []string
+
+	LogLines  []string
+	LogLevels []string
+	LogFiles  []LogFile
+
+	Settings []Setting
 }
 
 func NewResponse(r *http.Request, ps httprouter.Params) *Response {
@@ -60,7 +100,7 @@ func NewResponse(r *http.Request, ps httprouter.Params) *Response {
 	if err != nil {
 		panic(err)
 	}
-	return &Response{
+	res := &Response{
 		Config:   config.Get(),
 		Request:  r,
 		Params:   &ps,
@@ -70,14 +110,17 @@ func NewResponse(r *http.Request, ps httprouter.Params) *Response {
 		Backlink: backlink,
 		DiskInfo: diskInfo,
 		Archiver: archive,
+		Login:    reverseProxyAuthIP == "",
+		SSO:      sso != nil,
 	}
-}
-
-func logs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	for _, line := range logtail.Lines() {
-		fmt.Fprintf(w, "%s\n", line)
+	// Unauthenticated requests (e.g. public playlists) have no account.
+	if u, err := users.Get(res.User); err == nil {
+		res.Account = u
+		res.Admin = u.Admin
+		res.CSRF = csrfToken(u.Username)
 	}
+	res.Nonce = newNonce()
+	return res
 }
 
 func index(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -85,20 +128,13 @@ func index(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 }
 
 func home(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	// Accept TOS
-	if r.FormValue("tos") == "yes" {
-		if err := config.SetAcceptTOS(true); err != nil {
-			Error(w, err)
-			return
-		}
-	}
 	// Require TOS
 	if !config.Get().AcceptTOS {
 		Redirect(w, r, "/help")
 		return
 	}
 
-	lists, err := ListLists()
+	lists, err := UserLists(ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -124,21 +160,43 @@ func configHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 			Error(w, err)
 			return
 		}
+	case "normalize":
+		if u, err := users.Get(ps.ByName("user")); err != nil || !u.Admin || !tokenAllows(ps, ScopeAdmin) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		v := value == "on"
+		if err := config.SetNormalize(v); err != nil {
+			Error(w, err)
+			return
+		}
+		archive.SetNormalize(v)
 	}
 	JSON(w, "OK")
 }
 
 func importHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	var youtubes []youtube.Video
 	query := strings.TrimSpace(r.FormValue("q"))
+	youtubes, err := searchImports(query)
+	if err != nil {
+		logger.Errorf("query %q failed: %s", query, err)
+	}
 
-	if query != "" {
-		yt, err := youtube.Search(query)
-		if err != nil {
-			logger.Errorf("query %q failed: %s", query, err)
-		} else {
-			youtubes = append(youtubes, yt...)
-		}
+	res := NewResponse(r, ps)
+	res.Query = query
+	res.Youtubes = youtubes
+	res.Section = "import"
+	HTML(w, "import.html", res)
+}
+
+// searchImports searches YouTube, leaving out what's already in the library or being saved.
+func searchImports(query string) ([]youtube.Video, error) {
+	if query == "" {
+		return nil, nil
+	}
+	youtubes, err := youtube.Search(query)
+	if err != nil {
+		return nil, err
 	}
 
 	var filtered []youtube.Video
@@ -151,13 +209,7 @@ func importHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params)
 		}
 		filtered = append(filtered, v)
 	}
-	youtubes = filtered
-
-	res := NewResponse(r, ps)
-	res.Query = query
-	res.Youtubes = youtubes
-	res.Section = "import"
-	HTML(w, "import.html", res)
+	return filtered, nil
 }
 
 func help(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -166,8 +218,16 @@ func help(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	HTML(w, "help.html", res)
 }
 
+func acceptTOS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := config.SetAcceptTOS(true); err != nil {
+		Error(w, err)
+		return
+	}
+	Redirect(w, r, "/")
+}
+
 func library(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	medias, err := ListMedias()
+	medias, err := UserMedias(ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -176,22 +236,7 @@ func library(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	grandTotal := int64(len(medias))
 
 	query := r.FormValue("q")
-
-	// Filter
-	if query != "" {
-		var filtered []*Media
-		for _, m := range medias {
-			content := m.Title
-			content += m.Description
-			content += m.Author
-			content += m.Source
-			if !strings.Contains(strings.ToLower(content), strings.ToLower(query)) {
-				continue
-			}
-			filtered = append(filtered, m)
-		}
-		medias = filtered
-	}
+	medias = SearchMedias(medias, query)
 
 	// pagination
 	var limit int64 = 10
@@ -225,7 +270,7 @@ func library(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		end = total
 	}
 
-	lists, err := ListLists()
+	lists, err := UserLists(ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -249,7 +294,7 @@ func library(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 //
 
 func thumbnailMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	media, err := FindMedia(ps.ByName("media"))
+	media, err := FindUserMedia(ps.ByName("media"), ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -273,7 +318,7 @@ func thumbnailMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params
 }
 
 func viewMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	media, err := FindMedia(ps.ByName("media"))
+	media, err := FindUserMedia(ps.ByName("media"), ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -286,256 +331,1350 @@ func viewMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 }
 
 func deleteMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	if err := DeleteMedia(ps.ByName("media")); err != nil {
+	media, err := findEditableMedia(ps)
+	if err != nil {
 		Error(w, err)
 		return
 	}
-	Redirect(w, r, "/library?p=%s&q=%s&message=mediadeleted", r.FormValue("p"), r.FormValue("q"))
-}
-
-func downloadMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	media, err := FindMedia(ps.ByName("media"))
+	trashID, err := DeleteMedia(media.ID, ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
 	}
-	filename := filepath.Join(datadir, media.ID+".m4a")
-	nicename := strings.Trim(media.Title, `"`) + ".m4a"
-
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", nicename))
-	http.ServeFile(w, r, filename)
+	audit.Record(r, ps, "delete", "media", media.ID, media.Title)
+	Redirect(w, r, "/library?p=%s&q=%s&message=mediadeleted&trash=%s", r.FormValue("p"), r.FormValue("q"), trashID)
 }
 
-func streamMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	filename := filepath.Join(datadir, ps.ByName("filename"))
-	if id := ps.ByName("list"); id != "" {
-		if _, err := FindList(id); err != nil {
-			Error(w, err)
-			return
-		}
+func trimMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := findEditableMedia(ps)
+	if err != nil {
+		Error(w, err)
+		return
 	}
-	if strings.HasSuffix(filename, ".m4a") {
-		w.Header().Set("Content-Type", "video/mp4")
+	start, err := archiver.ParseTimestamp(r.FormValue("start"))
+	if err != nil {
+		Error(w, err)
+		return
 	}
-	http.ServeFile(w, r, filename)
-}
-
-//
-// Archiver
-//
-
-func archiverJobs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	res := NewResponse(r, ps)
-	res.ActiveMedias = ActiveMedias()
-	res.QueuedMedias = QueuedMedias()
-	HTML(w, "jobs.html", res)
+	end, err := archiver.ParseTimestamp(r.FormValue("end"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := media.Trim(r.Context(), start, end); err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("trimmed media %q from %.2f to %.2f", media.ID, start, end)
+	audit.Record(r, ps, "trim", "media", media.ID, fmt.Sprintf("%s (%.2f to %.2f)", media.Title, start, end))
+	Redirect(w, r, "/media/view/%s?message=mediatrimmed", media.ID)
 }
 
-func archiverSave(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	id := ps.ByName("id")
-	source := fmt.Sprintf("https://www.youtube.com/v?id=%s", id)
-
-	vinfo, err := ytdl.GetVideoInfoFromID(id)
+func splitMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := findEditableMedia(ps)
 	if err != nil {
 		Error(w, err)
 		return
 	}
-
-	media, err := NewMedia(vinfo.ID, vinfo.Author, vinfo.Title, int64(vinfo.Duration.Seconds()), source)
+	chapters := archiver.ParseTracklist(r.FormValue("tracklist"))
+	if chapters == nil {
+		res := NewResponse(r, ps)
+		res.Media = media
+		res.Section = "view"
+		res.Error = "The tracklist needs at least two timestamped lines (e.g. 0:00 First Song)."
+		HTML(w, "view.html", res)
+		return
+	}
+	list, err := media.Split(r.Context(), chapters)
+	if err == ErrAlreadySplit {
+		res := NewResponse(r, ps)
+		res.Media = media
+		res.Section = "view"
+		res.Error = "This was split into tracks before. Delete them to split it again."
+		HTML(w, "view.html", res)
+		return
+	}
 	if err != nil {
 		Error(w, err)
 		return
 	}
-	logger.Infof("created new media %q %q", media.ID, media.Title)
-
-	archive.Add(id, source)
-	JSON(w, "OK")
-}
-
-func archiverCancel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	archive.Remove(ps.ByName("id"))
-	Redirect(w, r, "/import?message=savecancelled")
+	logger.Infof("split media %q into %d tracks in playlist %q", media.ID, len(list.Medias), list.ID)
+	audit.Record(r, ps, "split", "media", media.ID, fmt.Sprintf("%s (%d tracks in playlist %s)", media.Title, len(list.Medias), list.ID))
+	Redirect(w, r, "/edit/%s?message=mediasplit", list.ID)
 }
 
-func deleteList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	list, err := FindList(ps.ByName("id"))
+func privateMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := findEditableMedia(ps)
 	if err != nil {
 		Error(w, err)
 		return
 	}
-	if err := DeleteList(list.ID); err != nil {
+	media.Private = r.FormValue("value") == "on"
+	if err := media.Save(); err != nil {
 		Error(w, err)
 		return
 	}
-	Redirect(w, r, "/?message=playlistdeleted")
+	action := "public"
+	if media.Private {
+		action = "private"
+	}
+	audit.Record(r, ps, action, "media", media.ID, media.Title)
+	JSON(w, "OK")
 }
 
-func podcastList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	list, err := FindList(ps.ByName("id"))
+// findEditableMedia finds the media in the request, if the user may change it.
+func findEditableMedia(ps httprouter.Params) (*Media, error) {
+	u, err := users.Get(ps.ByName("user"))
 	if err != nil {
-		http.NotFound(w, r)
-		return
+		return nil, err
 	}
-
-	proto := r.Header.Get("X-Forwarded-Proto")
-	if proto == "" {
-		proto = r.Method
+	media, err := FindUserMedia(ps.ByName("media"), u.Username)
+	if err != nil {
+		return nil, err
 	}
-	if proto != "http" {
-		proto = "https"
+	if !media.EditableBy(u) {
+		return nil, ErrMediaNotFound
 	}
-	baseurl := fmt.Sprintf("%s://%s%s", proto, httpHost, httpPrefix)
+	return media, nil
+}
 
-	p := podcast.New(list.Title, baseurl, list.Title, &list.Created, &list.Modified)
-	p.AddAuthor(httpHost, "soundscape@"+httpHost)
-	p.AddImage(baseurl + "/logo.png")
+// findEditableList finds the list with the id, if the user may change it.
+func findEditableList(id, username string) (*List, error) {
+	u, err := users.Get(username)
+	if err != nil {
+		return nil, err
+	}
+	list, err := FindUserList(id, u.Username)
+	if err != nil {
+		return nil, err
+	}
+	if !list.EditableBy(u) {
+		return nil, ErrListNotFound
+	}
+	return list, nil
+}
 
-	for _, media := range list.Medias {
-		typ := podcast.M4V
-		ext := "m4a"
-		filename := media.AudioFile()
+func downloadMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := FindUserMedia(ps.ByName("media"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	filename := filepath.Join(datadir, media.ID+".m4a")
+	nicename := strings.Trim(media.Title, `"`) + ".m4a"
 
-		fileInfo, err := os.Stat(filename)
-		if err != nil {
-			logger.Error(err)
-			continue
-		}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", nicename))
+	http.ServeFile(countStream(w, "download"), r, filename)
+}
 
-		streamurl, err := url.Parse(fmt.Sprintf("%s/stream/%s/%s.%s", baseurl, list.ID, media.ID, ext))
-		if err != nil {
-			Error(w, err)
+func streamMedia(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filename := filepath.Join(datadir, ps.ByName("filename"))
+	id := strings.SplitN(filepath.Base(filename), ".", 2)[0]
+	if key := ps.ByName("list"); key != "" {
+		// Only the media in the shared list.
+		list, _, err := sharedList(r, ps, key)
+		if err != nil || !list.HasMediaID(id) {
+			http.NotFound(w, r)
 			return
 		}
-
-		item := podcast.Item{
-			Title:       fmt.Sprintf("%s - %s", media.Title, media.Author),
-			Description: fmt.Sprintf("%s\n\n%s", media.Description, media.Created),
-			PubDate:     &media.Created,
-		}
-		item.AddEnclosure(streamurl.String(), typ, fileInfo.Size())
-		if _, err := p.AddItem(item); err != nil {
+	} else {
+		if _, err := FindUserMedia(id, ps.ByName("user")); err != nil {
 			Error(w, err)
 			return
 		}
 	}
-	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
-	if err := p.Encode(w); err != nil {
-		Error(w, err)
+	if strings.HasSuffix(filename, ".m4a") {
+		w.Header().Set("Content-Type", "video/mp4")
 	}
+	http.ServeFile(countStream(w, "media"), r, filename)
 }
 
-func m3uList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	list, err := FindList(ps.ByName("id"))
+func streamHLS(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, _, err := sharedList(r, ps, ps.ByName("list"))
+	if err != nil || !list.HasMediaID(ps.ByName("filename")) {
+		http.NotFound(w, r)
+		return
+	}
+	media, err := FindMedia(ps.ByName("filename"))
 	if err != nil {
 		http.NotFound(w, r)
 		return
 	}
 
-	ext := ".m4a"
-
-	w.Header().Set("Content-Type", "application/mpegurl")
-	fmt.Fprintf(w, "#EXTM3U\n")
-	for _, media := range list.Medias {
-		fmt.Fprintf(w, "#EXTINF:%d,%s\n", media.Length, media.Title)
-		proto := r.Header.Get("X-Forwarded-Proto")
-		if proto == "" {
-			proto = "https"
+	name := ps.ByName("hls")
+	switch {
+	case name == "index.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		if err := hls.WriteMaster(w); err != nil {
+			logger.Error(err)
+		}
+	case strings.HasSuffix(name, ".m3u8"):
+		rendition, ok := hls.FindRendition(strings.TrimSuffix(name, ".m3u8"))
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		playlist, err := segmenter.Playlist(r.Context(), media.AudioFile(), media.HLSDir(), rendition)
+		if err != nil {
+			Error(w, err)
+			return
 		}
-		fmt.Fprintf(w, "%s://%s%s/stream/%s/%s%s\n", proto, httpHost, httpPrefix, list.ID, media.ID, ext)
+		// It grows while the audio is being segmented.
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write(playlist)
+	case strings.HasSuffix(name, ".ts"):
+		w.Header().Set("Content-Type", "video/mp2t")
+		http.ServeFile(countStream(w, "hls"), r, filepath.Join(media.HLSDir(), filepath.Base(name)))
+	default:
+		http.NotFound(w, r)
 	}
 }
 
-func playList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	list, err := FindList(ps.ByName("id"))
-	if err != nil {
-		http.NotFound(w, r)
+//
+// Login
+//
+
+func login(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	next := localRedirect(r.FormValue("next"))
+
+	// The reverse proxy does the logging in.
+	if reverseProxyAuthIP != "" {
+		http.Redirect(w, r, next, http.StatusFound)
 		return
 	}
 
 	res := NewResponse(r, ps)
-	res.List = list
-	res.Section = "play"
-	HTML(w, "play.html", res)
-}
+	res.Section = "login"
 
-func createList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	if r.Method == "GET" {
-		res := NewResponse(r, ps)
-		res.Section = "create"
-		HTML(w, "create.html", res)
+		if _, err := sessions.Get(r); err == nil {
+			http.Redirect(w, r, next, http.StatusFound)
+			return
+		}
+		HTML(w, "login.html", res)
 		return
 	}
 
-	title := strings.TrimSpace(r.FormValue("title"))
+	ip := clientIP(r)
+	if allowed, wait := throttle.Allowed(ip); !allowed {
+		logger.Errorf("login throttled: client %q", ip)
+		res.Error = fmt.Sprintf("Too many failed logins. Try again in %d minutes.", int(wait.Minutes())+1)
+		w.WriteHeader(http.StatusTooManyRequests)
+		HTML(w, "login.html", res)
+		return
+	}
 
-	if title == "" {
-		Redirect(w, r, "/create")
+	username := strings.TrimSpace(r.FormValue("username"))
+	u, ok := users.Authenticate(username, r.FormValue("password"))
+	if !ok {
+		logger.Errorf("login failed: client %q user %q", ip, username)
+		throttle.Fail(ip)
+		res.Error = "Invalid username or password."
+		w.WriteHeader(http.StatusUnauthorized)
+		HTML(w, "login.html", res)
 		return
 	}
+	throttle.Reset(ip)
 
-	_, err := NewList(title)
-	if err != nil {
+	if _, err := sessions.Create(w, r, u.Username, r.FormValue("remember") == "on"); err != nil {
 		Error(w, err)
 		return
 	}
-	Redirect(w, r, "/library?message=playlistadded")
+	logger.Infof("user %q logged in from %q", u.Username, ip)
+	http.Redirect(w, r, next, http.StatusFound)
 }
 
-func removeMediaList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	media, err := FindMedia(ps.ByName("media"))
-	if err != nil {
-		Error(w, err)
-		return
+// localRedirect only allows local paths, so the login pages can't be used to send people elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, URL("/")) || strings.HasPrefix(next, "//") {
+		return URL("/")
 	}
-	list, err := FindList(ps.ByName("list"))
-	if err != nil {
-		Error(w, err)
+	return next
+}
+
+// oidcLogin sends the browser to the OpenID Connect provider to log in.
+func oidcLogin(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if sso == nil {
+		http.NotFound(w, r)
 		return
 	}
-	if err := list.RemoveMedia(media); err != nil {
-		Error(w, err)
+	startOIDC(w, r, localRedirect(r.FormValue("next")), "")
+}
+
+// linkSSO sends the browser to the OpenID Connect provider to link the
+// login there to the user's account.
+func linkSSO(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if sso == nil {
+		http.NotFound(w, r)
 		return
 	}
-	Redirect(w, r, "/edit/%s", list.ID)
+	startOIDC(w, r, URL("/account"), ps.ByName("user"))
 }
 
-func addMediaList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	media, err := FindMedia(ps.ByName("media"))
-	if err != nil {
-		Error(w, err)
+// startOIDC remembers the state, nonce, PKCE verifier, where to go next and
+// the account being linked (if any) in a short-lived signed cookie.
+func startOIDC(w http.ResponseWriter, r *http.Request, next, link string) {
+	var values []string
+	for i := 0; i < 3; i++ {
+		v, err := oidc.NewVerifier()
+		if err != nil {
+			Error(w, err)
+			return
+		}
+		values = append(values, v)
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	value := strings.Join([]string{
+		state, nonce, verifier,
+		base64.RawURLEncoding.EncodeToString([]byte(next)),
+		base64.RawURLEncoding.EncodeToString([]byte(link)),
+	}, ".")
+	setCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    value + "." + sessions.sign(value),
+		Path:     URL("/login/oidc"),
+		MaxAge:   600,
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+	})
+	http.Redirect(w, r, sso.AuthCodeURL(state, nonce, verifier), http.StatusFound)
+}
+
+func oidcCallback(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if sso == nil {
+		http.NotFound(w, r)
 		return
 	}
+	res := NewResponse(r, ps)
+	res.Section = "login"
+	failed := func(format string, a ...interface{}) {
+		res.Error = fmt.Sprintf(format, a...)
+		logger.Errorf("sso login failed: client %q: %s", clientIP(r), res.Error)
+		w.WriteHeader(http.StatusUnauthorized)
+		HTML(w, "login.html", res)
+	}
 
-	list, err := FindList(ps.ByName("list"))
+	// The cookie is only good once.
+	cookie, err := r.Cookie(oidcCookie)
+	setCookie(w, &http.Cookie{Name: oidcCookie, Path: URL("/login/oidc"), MaxAge: -1})
 	if err != nil {
-		Error(w, err)
+		failed("SSO login expired, please try again.")
+		return
+	}
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 6 || !hmac.Equal([]byte(parts[5]), []byte(sessions.sign(strings.Join(parts[:5], ".")))) {
+		failed("SSO login expired, please try again.")
 		return
 	}
+	state, nonce, verifier := parts[0], parts[1], parts[2]
+	next, _ := base64.RawURLEncoding.DecodeString(parts[3])
+	link, _ := base64.RawURLEncoding.DecodeString(parts[4])
 
-	list.AddMedia(media)
-	JSON(w, "OK")
-}
+	if e := r.FormValue("error"); e != "" {
+		failed("SSO login failed: %s %s", e, r.FormValue("error_description"))
+		return
+	}
+	if !hmac.Equal([]byte(r.FormValue("state")), []byte(state)) {
+		failed("SSO login failed: state mismatch.")
+		return
+	}
 
-func shuffleList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	list, err := FindList(ps.ByName("id"))
+	claims, err := sso.Exchange(r.Context(), r.FormValue("code"), verifier, nonce)
 	if err != nil {
-		Error(w, err)
+		failed("SSO login failed: %s", err)
 		return
 	}
-	if err := list.ShuffleMedia(); err != nil {
-		Error(w, err)
+
+	// Accounts are found by the issuer and subject. The username is only
+	// used to name new accounts.
+	identity := SSOIdentity(claims.Issuer, claims.Subject)
+	username := claims.String(oidcUsernameClaim)
+	if username == "" && claims.EmailVerified {
+		username = claims.Email
+	}
+	if username == "" {
+		username = claims.Subject
+	}
+	groups := claims.Strings(oidcGroupsClaim)
+	admin := oidcAdminGroup != "" && inGroup(groups, oidcAdminGroup)
+	if oidcUserGroup != "" && !inGroup(groups, oidcUserGroup) && !admin {
+		failed("%q is not allowed to use Soundscape.", username)
 		return
 	}
 
-	Redirect(w, r, "/play/%s", list.ID)
-}
-
-func editList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	list, err := FindList(ps.ByName("id"))
-	if err != nil {
+	// Linking needs the same browser to still be logged in to the account.
+	if len(link) > 0 {
+		if session, err := sessions.Get(r); err != nil || session.Username != string(link) {
+			failed("SSO link expired, please log in and try again.")
+			return
+		}
+		if err := users.LinkSSO(string(link), identity); err != nil {
+			failed("SSO link failed: %s", err)
+			return
+		}
+		logger.Infof("user %q linked to sso subject %q from %q", string(link), claims.Subject, clientIP(r))
+		http.Redirect(w, r, URL("/account?message=ssolinked"), http.StatusFound)
+		return
+	}
+
+	u, err := users.ProvisionSSO(identity, username)
+	if err != nil {
+		failed("SSO login failed: %s", err)
+		return
+	}
+	// The provider decides who is an admin, if it's told which group they're in.
+	if oidcAdminGroup != "" && u.Admin != admin {
+		if err := users.SetAdmin(u.Username, admin); err != nil {
+			Error(w, err)
+			return
+		}
+		logger.Infof("user %q admin role set to %t by group %q", u.Username, admin, oidcAdminGroup)
+	}
+
+	if _, err := sessions.Create(w, r, u.Username, false); err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q logged in with sso (subject %q) from %q", u.Username, claims.Subject, clientIP(r))
+	http.Redirect(w, r, localRedirect(string(next)), http.StatusFound)
+}
+
+func inGroup(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+func logout(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := sessions.Delete(w, r); err != nil {
+		Error(w, err)
+		return
+	}
+	Redirect(w, r, "/login?message=loggedout")
+}
+
+func account(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res := NewResponse(r, ps)
+	res.Section = "account"
+	HTML(w, "account.html", res)
+}
+
+func changePassword(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	username := ps.ByName("user")
+	password := r.FormValue("password")
+
+	res := NewResponse(r, ps)
+	res.Section = "account"
+
+	var err error
+	switch {
+	case reverseProxyAuthIP != "":
+		err = fmt.Errorf("passwords are managed by the reverse proxy")
+	case !res.Account.CheckPassword(r.FormValue("current")):
+		err = fmt.Errorf("current password is incorrect")
+	case password != r.FormValue("confirm"):
+		err = fmt.Errorf("passwords don't match")
+	default:
+		err = ValidatePassword(password)
+	}
+	if err == nil {
+		err = users.SetPassword(username, password)
+	}
+	if err != nil {
+		res.Error = err.Error()
+		HTML(w, "account.html", res)
+		return
+	}
+
+	// Log out everywhere, including here.
+	if err := sessions.DeleteUser(username); err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q changed their password", username)
+	audit.Record(r, ps, "password", "user", username, "")
+	Redirect(w, r, "/login?message=passwordchanged")
+}
+
+//
+// Tokens
+//
+
+func tokensHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res := NewResponse(r, ps)
+	res.Tokens = tokens.List(res.User)
+	res.Scopes = Scopes
+	res.Section = "tokens"
+	HTML(w, "tokens.html", res)
+}
+
+func createToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res := NewResponse(r, ps)
+	res.Scopes = Scopes
+	res.Section = "tokens"
+
+	if err := r.ParseForm(); err != nil {
+		Error(w, err)
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	scopes := r.Form["scope"]
+
+	var err error
+	switch {
+	case name == "":
+		err = fmt.Errorf("the token needs a name")
+	case len(scopes) == 0:
+		err = fmt.Errorf("the token needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if (scope == ScopeAdmin || scope == ScopeMetrics) && !res.Admin {
+			err = fmt.Errorf("only admins can create %s tokens", scope)
+		}
+	}
+	if err == nil {
+		var t Token
+		t, res.NewToken, err = tokens.Create(res.User, name, scopes)
+		if err == nil {
+			logger.Infof("user %q created token %q (%s) with scopes %s", res.User, t.Name, t.ID, strings.Join(t.Scopes, ", "))
+			audit.Record(r, ps, "create", "token", t.ID, fmt.Sprintf("%s (%s)", t.Name, strings.Join(t.Scopes, ", ")))
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	res.Tokens = tokens.List(res.User)
+	HTML(w, "tokens.html", res)
+}
+
+func revokeToken(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if err := tokens.Revoke(ps.ByName("user"), ps.ByName("id")); err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q revoked token %q", ps.ByName("user"), ps.ByName("id"))
+	audit.Record(r, ps, "revoke", "token", ps.ByName("id"), "")
+	Redirect(w, r, "/tokens?message=tokenrevoked")
+}
+
+//
+// Users
+//
+
+func usersHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res := NewResponse(r, ps)
+	res.Users = users.List()
+	res.Section = "users"
+	HTML(w, "users.html", res)
+}
+
+func createUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	username := strings.TrimSpace(r.FormValue("username"))
+	password := r.FormValue("password")
+
+	err := ValidatePassword(password)
+	if err == nil {
+		_, err = users.Add(username, password, r.FormValue("admin") == "on")
+	}
+	if err != nil {
+		res := NewResponse(r, ps)
+		res.Users = users.List()
+		res.Section = "users"
+		res.Error = err.Error()
+		HTML(w, "users.html", res)
+		return
+	}
+	logger.Infof("user %q created user %q", ps.ByName("user"), username)
+	audit.Record(r, ps, "create", "user", username, "")
+	Redirect(w, r, "/users?message=useradded")
+}
+
+func adminUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	username := ps.ByName("username")
+	if username == ps.ByName("user") {
+		http.Error(w, "you can't change your own admin role", http.StatusBadRequest)
+		return
+	}
+	admin := r.FormValue("value") == "on"
+	if err := users.SetAdmin(username, admin); err != nil {
+		Error(w, err)
+		return
+	}
+	action := "unadmin"
+	if admin {
+		action = "admin"
+	}
+	audit.Record(r, ps, action, "user", username, "")
+	JSON(w, "OK")
+}
+
+func deleteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	username := ps.ByName("username")
+	if username == ps.ByName("user") {
+		http.Error(w, "you can't delete yourself", http.StatusBadRequest)
+		return
+	}
+	medias, lists, err := ReassignOwner(username, ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := users.Delete(username); err != nil {
+		Error(w, err)
+		return
+	}
+	if err := sessions.DeleteUser(username); err != nil {
+		Error(w, err)
+		return
+	}
+	if err := tokens.DeleteUser(username); err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q deleted user %q, taking over %d media and %d playlists", ps.ByName("user"), username, medias, lists)
+	audit.Record(r, ps, "delete", "user", username, fmt.Sprintf("%d media and %d playlists reassigned", medias, lists))
+	Redirect(w, r, "/users?message=userdeleted")
+}
+
+//
+// Trash
+//
+
+func trashHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res, err := trashResponse(r, ps)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	HTML(w, "trash.html", res)
+}
+
+func trashResponse(r *http.Request, ps httprouter.Params) (*Response, error) {
+	res := NewResponse(r, ps)
+	res.Section = "trash"
+	res.TrashRetention = strings.TrimSpace(humanize.RelTime(time.Now(), time.Now().Add(TrashRetention()), "", ""))
+	items, err := ListTrash()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range items {
+		if t.VisibleTo(res.Account) {
+			res.Trash = append(res.Trash, t)
+		}
+	}
+	return res, nil
+}
+
+// findUserTrash finds the trash item in the request, if the user may restore or purge it.
+func findUserTrash(ps httprouter.Params) (TrashItem, error) {
+	u, err := users.Get(ps.ByName("user"))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	t, err := FindTrash(ps.ByName("id"))
+	if err != nil {
+		return TrashItem{}, err
+	}
+	if !t.VisibleTo(u) {
+		return TrashItem{}, ErrTrashNotFound
+	}
+	return t, nil
+}
+
+func restoreTrash(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t, err := findUserTrash(ps)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := t.Restore(); err == ErrTrashConflict {
+		res, err := trashResponse(r, ps)
+		if err != nil {
+			Error(w, err)
+			return
+		}
+		res.Error = fmt.Sprintf("%q can't be restored: %s.", t.Title(), ErrTrashConflict)
+		HTML(w, "trash.html", res)
+		return
+	} else if err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q restored %s %q from the trash", ps.ByName("user"), t.Kind(), t.Title())
+	if t.Media != nil {
+		audit.Record(r, ps, "restore", "media", t.Media.ID, t.Media.Title)
+		Redirect(w, r, "/media/view/%s?message=trashrestored", t.Media.ID)
+		return
+	}
+	audit.Record(r, ps, "restore", "list", t.List.ID, t.List.Title)
+	Redirect(w, r, "/edit/%s?message=trashrestored", t.List.ID)
+}
+
+func purgeTrash(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	t, err := findUserTrash(ps)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := t.Purge(); err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q purged %s %q from the trash", ps.ByName("user"), t.Kind(), t.Title())
+	if t.Media != nil {
+		audit.Record(r, ps, "purge", "media", t.Media.ID, t.Media.Title)
+	} else {
+		audit.Record(r, ps, "purge", "list", t.List.ID, t.List.Title)
+	}
+	Redirect(w, r, "/trash?message=trashpurged")
+}
+
+//
+// Audit
+//
+
+func auditHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filter := AuditFilter{
+		User:   strings.TrimSpace(r.FormValue("user")),
+		Action: strings.TrimSpace(r.FormValue("action")),
+		Target: strings.TrimSpace(r.FormValue("target")),
+		ID:     strings.TrimSpace(r.FormValue("id")),
+	}
+	// Dates are whole days, so "until" includes the day itself.
+	if t, err := time.ParseInLocation("2006-01-02", r.FormValue("since"), time.Local); err == nil {
+		filter.Since = t
+	}
+	if t, err := time.ParseInLocation("2006-01-02", r.FormValue("until"), time.Local); err == nil {
+		filter.Until = t.AddDate(0, 0, 1)
+	}
+
+	// Exports have everything that matches; the page only the latest.
+	if r.FormValue("format") == "json" {
+		events, err := audit.Query(filter)
+		if err != nil {
+			Error(w, err)
+			return
+		}
+		if events == nil {
+			events = []AuditEvent{}
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="soundscape-audit-%s.json"`, time.Now().Format("20060102")))
+		JSON(w, events)
+		return
+	}
+
+	filter.Limit = 500
+	events, err := audit.Query(filter)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	res := NewResponse(r, ps)
+	res.AuditEvents = events
+	res.AuditActions = AuditActions
+	res.AuditTargets = AuditTargets
+	res.Section = "audit"
+	HTML(w, "audit.html", res)
+}
+
+//
+// Archiver
+//
+
+func archiverJobs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res := NewResponse(r, ps)
+	res.ActiveMedias = VisibleMedias(ActiveMedias(), res.User)
+	res.QueuedMedias = VisibleMedias(QueuedMedias(), res.User)
+	res.FailedMedias = VisibleMedias(FailedMedias(), res.User)
+	HTML(w, "jobs.html", res)
+}
+
+func archiverSave(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := saveImport(ps.ByName("id"), ps.ByName("user"), RequestID(r), archiver.PriorityUser)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	audit.Record(r, ps, "save", "job", media.ID, media.Title)
+	JSON(w, "OK")
+}
+
+// saveImport creates the media for a YouTube video and queues the job that archives it.
+func saveImport(id, owner, requestID string, priority archiver.Priority) (*Media, error) {
+	source := fmt.Sprintf("https://www.youtube.com/v?id=%s", id)
+
+	// Media saved before keeps its owner and settings; only its audio is
+	// archived again if it's missing.
+	if media, err := loadMedia(id); err == nil {
+		if !media.HasAudio() && !archive.InProgress(media.ID) {
+			archive.Add(media.ID, source, requestID, priority)
+		}
+		return media, nil
+	}
+
+	vinfo, err := ytdl.GetVideoInfoFromID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	media, err := NewMedia(vinfo.ID, vinfo.Author, vinfo.Title, vinfo.Description, int64(vinfo.Duration.Seconds()), source, owner)
+	if err != nil {
+		return nil, err
+	}
+	logger.Infof("created new media %q %q", media.ID, media.Title)
+
+	archive.Add(id, source, requestID, priority)
+	return media, nil
+}
+
+// archiverMove moves a queued job to the ?position (0 starts next).
+func archiverMove(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	if !mayChangeImport(id, ps.ByName("user")) {
+		httpError(w, r, http.StatusForbidden)
+		return
+	}
+	position, err := strconv.Atoi(r.FormValue("position"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := archive.Move(id, position); err != nil {
+		Error(w, err)
+		return
+	}
+	audit.Record(r, ps, "reorder", "job", id, fmt.Sprintf("position %d", position))
+	Redirect(w, r, "/import")
+}
+
+// archiverEvents streams the archiver's job events as server-sent events,
+// each a JSON archiver.Event.
+func archiverEvents(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Error(w, fmt.Errorf("streaming isn't supported"))
+		return
+	}
+
+	sub := archive.Subscribe()
+	defer sub.Close()
+
+	// Only the jobs of media the user can see, decided when each job is
+	// first seen, since a cancelled job's media is gone by its last event.
+	visible := make(map[string]bool)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e := <-sub.Events():
+			ok, seen := visible[e.Job]
+			if !seen {
+				media, err := loadMedia(e.Job)
+				ok = err == nil && media.VisibleTo(ps.ByName("user"))
+				visible[e.Job] = ok
+			}
+			if !ok {
+				continue
+			}
+			b, err := json.Marshal(e)
+			if err != nil {
+				logger.Error(err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-sub.Done():
+			// Dropped for falling behind or shutting down; the browser reconnects.
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func archiverCancel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	if !mayChangeImport(id, ps.ByName("user")) {
+		httpError(w, r, http.StatusForbidden)
+		return
+	}
+	if CancelImport(id) {
+		logger.Infof("user %q cancelled job %q", ps.ByName("user"), id)
+		audit.Record(r, ps, "cancel", "job", id, "")
+	}
+	Redirect(w, r, "/import?message=savecancelled")
+}
+
+// mayChangeImport reports whether the user may cancel the job or move it in
+// the queue: the owner of its media and admins can.
+func mayChangeImport(id, username string) bool {
+	u, err := users.Get(username)
+	if err != nil {
+		return false
+	}
+	if u.Admin {
+		return true
+	}
+	media, err := loadMedia(id)
+	return err == nil && media.EditableBy(u)
+}
+
+func archiverCancelAll(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	for _, id := range CancelImports() {
+		logger.Infof("user %q cancelled job %q", ps.ByName("user"), id)
+		audit.Record(r, ps, "cancel", "job", id, "")
+	}
+	Redirect(w, r, "/import?message=jobscancelled")
+}
+
+func archiverClearFailed(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	for _, id := range ClearFailedImports() {
+		audit.Record(r, ps, "remove", "job", id, "failed")
+	}
+	Redirect(w, r, "/import?message=failedcleared")
+}
+
+func deleteList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	trashID, err := DeleteList(list.ID, ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	audit.Record(r, ps, "delete", "list", list.ID, list.Title)
+	Redirect(w, r, "/?message=playlistdeleted&trash=%s", trashID)
+}
+
+func podcastList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("id")
+	list, ok := sharedFeed(w, r, ps, key)
+	if !ok {
+		return
+	}
+
+	p := podcast.New(list.Title, AbsoluteURL(r, "/play/%s", key), list.Title, &list.Created, &list.Modified)
+	p.AddAuthor(httpHost, "soundscape@"+httpHost)
+	p.AddImage(AbsoluteURL(r, "/logo.png"))
+
+	for _, media := range list.Medias {
+		typ := podcast.M4V
+		ext := "m4a"
+		filename := media.AudioFile()
+
+		fileInfo, err := os.Stat(filename)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+
+		streamurl, err := url.Parse(AbsoluteURL(r, "/stream/%s/%s.%s", key, media.ID, ext))
+		if err != nil {
+			Error(w, err)
+			return
+		}
+
+		item := podcast.Item{
+			Title:       fmt.Sprintf("%s - %s", media.Title, media.Author),
+			Description: fmt.Sprintf("%s\n\n%s", media.Description, media.Created),
+			PubDate:     &media.Created,
+		}
+		item.AddEnclosure(streamurl.String(), typ, fileInfo.Size())
+		if _, err := p.AddItem(item); err != nil {
+			Error(w, err)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	if err := p.Encode(w); err != nil {
+		Error(w, err)
+	}
+}
+
+func m3uList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("id")
+	list, ok := sharedFeed(w, r, ps, key)
+	if !ok {
+		return
+	}
+
+	ext := ".m4a"
+
+	w.Header().Set("Content-Type", "application/mpegurl")
+	fmt.Fprintf(w, "#EXTM3U\n")
+	for _, media := range list.Medias {
+		fmt.Fprintf(w, "#EXTINF:%d,%s\n", media.Length, media.Title)
+		fmt.Fprintf(w, "%s\n", AbsoluteURL(r, "/stream/%s/%s%s", key, media.ID, ext))
+	}
+}
+
+func radioList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("id")
+	list, ok := sharedFeed(w, r, ps, key)
+	if !ok {
+		return
+	}
+	format, ok := radio.FindFormat(r.FormValue("format"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Clients ask for ICY metadata (the current song title) with this header.
+	icy := r.Header.Get("Icy-MetaData") == "1"
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("icy-name", list.Title)
+	w.Header().Set("icy-br", strings.TrimSuffix(radio.Bitrate, "k"))
+	if icy {
+		w.Header().Set("icy-metaint", strconv.Itoa(radio.MetaInt))
+	}
+
+	// Each share gets its own station, so revoking one only stops its listeners.
+	// Users listening to their own playlists get the playlist's station.
+	id := key
+	_, err := shares.Find(key)
+	shared := err == nil
+	if !shared {
+		id = "list:" + key
+	}
+	station := stations.Station(id, format, radioPlaylist(key, shared))
+	if err := station.Listen().Stream(r.Context(), countStream(w, "radio"), icy); err != nil {
+		logger.Debugf("radio %q listener %q disconnected: %s", key, r.RemoteAddr, err)
+	}
+}
+
+// radioPlaylist plays the share's playlist, or the list itself if it isn't
+// shared. A share that's revoked or expires stops the station on the next pass.
+func radioPlaylist(key string, shared bool) radio.Playlist {
+	return func() ([]radio.Track, bool, error) {
+		var list *List
+		var err error
+		if shared {
+			var share Share
+			if share, err = shares.Find(key); err == nil {
+				list, err = share.List()
+			}
+		} else {
+			list, err = FindList(key)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		var tracks []radio.Track
+		for _, media := range list.Medias {
+			if !media.HasAudio() {
+				continue
+			}
+			tracks = append(tracks, radio.Track{Title: media.Title, Filename: media.AudioFile()})
+		}
+		return tracks, list.RadioShuffle, nil
+	}
+}
+
+func playList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("id")
+	list, share, err := sharedList(r, ps, key)
+	if err == ErrShareLocked {
+		res := NewResponse(r, ps)
+		res.Share = share
+		res.Key = key
+		res.Section = "share"
+		HTML(w, "share.html", res)
+		return
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if share != nil {
+		if err := shares.View(share.ID); err != nil {
+			logger.Error(err)
+		}
+	}
+
+	res := NewResponse(r, ps)
+	res.List = list
+	res.Share = share
+	res.Key = key
+	res.Section = "play"
+	HTML(w, "play.html", res)
+}
+
+// sharedList finds the list for a public route from a share id, or for
+// logged in users, the id of a list they can see.
+func sharedList(r *http.Request, ps httprouter.Params, key string) (*List, *Share, error) {
+	share, err := shares.Find(key)
+	if err == nil && share.Radio && !strings.HasPrefix(r.URL.Path, Prefix("/radio/")) {
+		err = ErrShareNotFound
+	}
+	if err == nil {
+		if !shares.Unlocked(r, share) {
+			return nil, &share, ErrShareLocked
+		}
+		list, err := share.List()
+		return list, &share, err
+	}
+	if user := ps.ByName("user"); user != "" {
+		list, err := FindUserList(key, user)
+		return list, nil, err
+	}
+	return nil, nil, err
+}
+
+// sharedFeed finds the list for a feed (m3u, podcast, radio), counting the view.
+// Feed clients can't use the password page, so they send the password with basic auth.
+func sharedFeed(w http.ResponseWriter, r *http.Request, ps httprouter.Params, key string) (*List, bool) {
+	list, share, err := sharedList(r, ps, key)
+	if err == ErrShareLocked {
+		w.Header().Set("WWW-Authenticate", `Basic realm="Password Required"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return nil, false
+	}
+	if err != nil {
+		http.NotFound(w, r)
+		return nil, false
+	}
+	if share != nil {
+		if err := shares.View(share.ID); err != nil {
+			logger.Error(err)
+		}
+	}
+	return list, true
+}
+
+func unlockShare(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("id")
+	share, err := shares.Find(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ip := clientIP(r)
+	if allowed, _ := throttle.Allowed(ip); !allowed || !share.CheckPassword(r.FormValue("password")) {
+		if allowed {
+			throttle.Fail(ip)
+		}
+		res := NewResponse(r, ps)
+		res.Share = &share
+		res.Key = key
+		res.Section = "share"
+		res.Error = "Wrong password."
+		w.WriteHeader(http.StatusUnauthorized)
+		HTML(w, "share.html", res)
+		return
+	}
+	shares.Grant(w, r, share)
+	Redirect(w, r, "/play/%s", key)
+}
+
+func downloadShare(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, share, err := sharedList(r, ps, ps.ByName("id"))
+	if err != nil || share == nil || !share.Download || !list.HasMediaID(ps.ByName("media")) {
+		http.NotFound(w, r)
+		return
+	}
+	media, err := FindMedia(ps.ByName("media"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	nicename := strings.Trim(media.Title, `"`) + ".m4a"
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", nicename))
+	http.ServeFile(countStream(w, "download"), r, media.AudioFile())
+}
+
+//
+// Shares
+//
+
+func sharesHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res := NewResponse(r, ps)
+	res.Shares = shares.List(res.User, "", "")
+
+	// Admins look after the shares of shared playlists.
+	if res.Admin {
+		res.Shares = append(res.Shares, shares.List("", "", "")...)
+	}
+	res.Section = "shares"
+	HTML(w, "shares.html", res)
+}
+
+func createShare(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	user := ps.ByName("user")
+	listID := r.FormValue("list")
+	mediaID := r.FormValue("media")
+
+	var err error
+	if mediaID != "" {
+		_, err = FindUserMedia(mediaID, user)
+	} else {
+		_, err = FindUserList(listID, user)
+	}
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	days, _ := strconv.ParseInt(r.FormValue("days"), 10, 64)
+	if days < 0 {
+		days = 0
+	}
+	ttl := time.Duration(days) * 24 * time.Hour
+
+	share, err := shares.Create(user, listID, mediaID, r.FormValue("password"), r.FormValue("download") == "on", ttl)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q shared list %q media %q as %q", user, share.ListID, share.MediaID, share.ID)
+	detail := "list " + share.ListID
+	if share.MediaID != "" {
+		detail = "media " + share.MediaID
+	}
+	audit.Record(r, ps, "create", "share", share.ID, detail)
+	Redirect(w, r, "/shares?message=sharecreated")
+}
+
+func revokeShare(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	u, err := users.Get(ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := shares.Revoke(u, ps.ByName("id")); err != nil {
+		Error(w, err)
+		return
+	}
+	stations.StopStation(ps.ByName("id"))
+	logger.Infof("user %q revoked share %q", u.Username, ps.ByName("id"))
+	audit.Record(r, ps, "revoke", "share", ps.ByName("id"), "")
+	Redirect(w, r, "/shares?message=sharerevoked")
+}
+
+func createList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if r.Method == "GET" {
+		res := NewResponse(r, ps)
+		res.Section = "create"
+		HTML(w, "create.html", res)
+		return
+	}
+
+	title := strings.TrimSpace(r.FormValue("title"))
+
+	if title == "" {
+		Redirect(w, r, "/create")
+		return
+	}
+
+	list, err := NewList(title, ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	audit.Record(r, ps, "create", "list", list.ID, list.Title)
+	Redirect(w, r, "/library?message=playlistadded")
+}
+
+func removeMediaList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := FindUserMedia(ps.ByName("media"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	list, err := findEditableList(ps.ByName("list"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := list.RemoveMedia(media); err != nil {
+		Error(w, err)
+		return
+	}
+	audit.Record(r, ps, "remove", "list", list.ID, fmt.Sprintf("%s (%s)", media.Title, media.ID))
+	Redirect(w, r, "/edit/%s", list.ID)
+}
+
+func addMediaList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	media, err := FindUserMedia(ps.ByName("media"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	list, err := findEditableList(ps.ByName("list"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	list.AddMedia(media)
+	audit.Record(r, ps, "add", "list", list.ID, fmt.Sprintf("%s (%s)", media.Title, media.ID))
+	JSON(w, "OK")
+}
+
+func shuffleList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := list.ShuffleMedia(); err != nil {
 		Error(w, err)
 		return
 	}
+	audit.Record(r, ps, "shuffle", "list", list.ID, list.Title)
+
+	Redirect(w, r, "/play/%s", list.ID)
+}
+
+func editList(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	list, err := findEditableList(ps.ByName("id"), ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	if r.Method == "POST" {
+		switch r.FormValue("radioshuffle") {
+		case "on":
+			list.RadioShuffle = true
+		case "off":
+			list.RadioShuffle = false
+		}
+		if err := list.Save(); err != nil {
+			Error(w, err)
+			return
+		}
+		audit.Record(r, ps, "edit", "list", list.ID, fmt.Sprintf("radio shuffle %t", list.RadioShuffle))
+		JSON(w, "OK")
+		return
+	}
 
 	res := NewResponse(r, ps)
 	res.List = list
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// The archiver manager checks its queue at least every 10 seconds.
+	archiverHeartbeatTimeout = 30 * time.Second
+
+	// ffmpeg and ffprobe only change with the container image, so they're
+	// not run on every probe.
+	toolCheckInterval = 5 * time.Minute
+)
+
+// Check is the result of one health check.
+type Check struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+// Health is the response of /healthz and /readyz.
+type Health struct {
+	Status  string           `json:"status"` // "ok" or "fail"
+	Version string           `json:"version"`
+	Checks  map[string]Check `json:"checks"`
+}
+
+func (h *Health) add(name string, c Check) {
+	h.Checks[name] = c
+	if !c.OK {
+		h.Status = "fail"
+	}
+}
+
+func newHealth() *Health {
+	return &Health{Status: "ok", Version: version, Checks: make(map[string]Check)}
+}
+
+// healthz is the liveness check: it fails when Soundscape is stuck and needs a restart.
+func healthz(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	h := newHealth()
+	h.add("archiver", checkArchiver())
+	writeHealth(w, h)
+}
+
+// readyz is the readiness check: it fails when Soundscape can't do its job,
+// e.g. the data directory is full or ffmpeg is missing.
+func readyz(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	h := newHealth()
+	h.add("archiver", checkArchiver())
+	h.add("datadir", checkDatadir())
+	h.add("disk", checkDisk())
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		h.add(tool, tools.Check(tool))
+	}
+	writeHealth(w, h)
+}
+
+func writeHealth(w http.ResponseWriter, h *Health) {
+	status := http.StatusOK
+	if h.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	apiJSON(w, status, h)
+}
+
+func checkArchiver() Check {
+	heartbeat := archive.Heartbeat()
+	if since := time.Since(heartbeat); since > archiverHeartbeatTimeout {
+		return Check{Message: fmt.Sprintf("the archiver manager hasn't checked the queue for %s", since.Round(time.Second))}
+	}
+	return Check{OK: true, Message: fmt.Sprintf("%d active, %d queued", len(archive.ActiveJobs()), len(archive.QueuedJobs()))}
+}
+
+func checkDatadir() Check {
+	f, err := ioutil.TempFile(datadir, ".healthz")
+	if err != nil {
+		return Check{Message: fmt.Sprintf("%s isn't writable: %s", datadir, err)}
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return Check{Message: fmt.Sprintf("writing to %s failed: %s", datadir, err)}
+	}
+	if err := f.Close(); err != nil {
+		return Check{Message: fmt.Sprintf("writing to %s failed: %s", datadir, err)}
+	}
+	return Check{OK: true, Message: datadir + " is writable"}
+}
+
+func checkDisk() Check {
+	d, err := NewDiskInfo(datadir)
+	if err != nil {
+		return Check{Message: err.Error()}
+	}
+	free := humanize.Bytes(uint64(d.Free()))
+	if min := MinFreeSpace(); uint64(d.Free()) < min {
+		return Check{Message: fmt.Sprintf("%s free, less than the minimum %s", free, humanize.Bytes(min))}
+	}
+	return Check{OK: true, Message: fmt.Sprintf("%s free (%.0f%% used)", free, d.UsedPercent())}
+}
+
+// toolChecker finds ffmpeg and ffprobe and their versions, remembering the results for a while.
+type toolChecker struct {
+	sync.Mutex
+	checks  map[string]Check
+	checked map[string]time.Time
+}
+
+var tools = &toolChecker{checks: make(map[string]Check), checked: make(map[string]time.Time)}
+
+func (t *toolChecker) Check(name string) Check {
+	t.Lock()
+	defer t.Unlock()
+	if time.Since(t.checked[name]) < toolCheckInterval {
+		return t.checks[name]
+	}
+	c := checkTool(name)
+	t.checks[name] = c
+	t.checked[name] = time.Now()
+	return c
+}
+
+func checkTool(name string) Check {
+	exe, err := exec.LookPath(name)
+	if err != nil {
+		return Check{Message: fmt.Sprintf("%s not found in PATH", name)}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	output, err := exec.CommandContext(ctx, exe, "-version").Output()
+	if err != nil {
+		return Check{Message: fmt.Sprintf("%s -version failed: %s", exe, err)}
+	}
+	// e.g. "ffmpeg version 4.4.2-0ubuntu0.22.04.1 Copyright (c) 2000-2021 the FFmpeg developers"
+	fields := strings.Fields(strings.SplitN(string(output), "\n", 2)[0])
+	if len(fields) < 3 || fields[1] != "version" {
+		return Check{Message: fmt.Sprintf("%s -version printed something unexpected", exe)}
+	}
+	return Check{OK: true, Message: fmt.Sprintf("%s version %s", exe, fields[2])}
+}
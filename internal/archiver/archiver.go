@@ -3,6 +3,7 @@ package archiver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -22,26 +23,108 @@ import (
 
 var (
 	HTTPUserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/55.0.2883.87 Safari/537.36"
+
+	ErrNotQueued = errors.New("the job isn't queued")
 )
 
-type Job struct {
-	id      string
-	source  string
-	context *context.Context
-	cancel  *context.CancelFunc
+// The manager starts jobs as soon as something changes, and also at least
+// this often, to follow the schedule and show it's alive.
+const heartbeatInterval = 10 * time.Second
+
+// Priority decides which queued jobs start first.
+type Priority int
 
-	imagefile string
-	videofile string
-	audiofile string
+const (
+	// PriorityUser is for imports somebody asked for.
+	PriorityUser Priority = iota
+	// PrioritySubscription is for imports made automatically, which wait for the others.
+	PrioritySubscription
+)
+
+// ParsePriority parses "user" or "subscription"; empty is "user".
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "", "user":
+		return PriorityUser, nil
+	case "subscription":
+		return PrioritySubscription, nil
+	}
+	return 0, fmt.Errorf("invalid priority %q: must be user or subscription", s)
+}
+
+func (p Priority) String() string {
+	if p == PrioritySubscription {
+		return "subscription"
+	}
+	return "user"
+}
+
+// Result describes a successfully archived job.
+type Result struct {
+	ID       string
+	Loudness *Loudness
+
+	// Leading and trailing silence that was cut, as positions in the source audio.
+	TrimStart float64
+	TrimEnd   float64
+
+	// Length of the archived audio in seconds.
+	Length float64
+
+	// Chapters found in the source or its description, positioned in the source audio.
+	Chapters []Chapter
+}
+
+// PendingJob is a job that didn't finish before the archiver shut down,
+// so it can be added again after a restart.
+type PendingJob struct {
+	ID        string   `json:"id"`
+	Source    string   `json:"source"`
+	RequestID string   `json:"request_id,omitempty"`
+	Priority  Priority `json:"priority,omitempty"`
+}
+
+type Job struct {
+	id       string
+	source   string
+	priority Priority
+	context  *context.Context
+	cancel   *context.CancelFunc
+
+	// the request that added the job, and the logger that includes it
+	requestID string
+	logger    *zap.SugaredLogger
+
+	// Cancelled by Remove, interrupted by Shutdown, and why it failed
+	// otherwise. Once it's finishing the result is being saved, and it can't
+	// be cancelled or interrupted anymore.
+	cancelled   bool
+	interrupted bool
+	finishing   bool
+	err         error
+
+	// Whether the audio was archived before, so cleaning up keeps it.
+	hadAudio bool
+
+	imagefile  string
+	videofile  string
+	audiofile  string
+	sourcefile string
 }
 
 func NewArchiver(datadir string, concurrency int, logger *zap.SugaredLogger) *Archiver {
+	ctx, stop := context.WithCancel(context.Background())
 	a := &Archiver{
 		datadir:     datadir,
 		concurrency: concurrency,
 		active:      make(map[string]*Job),
-		failed:      make(map[string]error),
+		failed:      make(map[string]*Job),
 		logger:      logger,
+		bandwidth:   &limiter{},
+		events:      hub{subscriptions: make(map[*Subscription]struct{})},
+		wake:        make(chan struct{}, 1),
+		ctx:         ctx,
+		stop:        stop,
 	}
 	go a.manager()
 	return a
@@ -53,15 +136,137 @@ type Archiver struct {
 	concurrency int
 	queue       []*Job
 	active      map[string]*Job
-	failed      map[string]error
+	failed      map[string]*Job
 	logger      *zap.SugaredLogger
 	debug       bool
+	normalize   bool
+	onComplete  func(Result)
+	onCancel    func(id string)
+	onPhase     func(phase string, elapsed time.Duration, err error)
+
+	// Download rate shared by all jobs, and when jobs may start.
+	bandwidth *limiter
+	schedule  Schedule
+	paused    bool
+
+	// Subscriptions to the jobs' events.
+	events hub
+
+	// Wakes the manager up when there may be a job to start, and stops it.
+	wake chan struct{}
+	ctx  context.Context
+	stop context.CancelFunc
+
+	// Shutting down: queued jobs are no longer started.
+	stopping bool
+	jobs     sync.WaitGroup
+
+	// When the manager last checked the queue.
+	heartbeat time.Time
+}
+
+// OnComplete sets a function to be called after each successful job.
+func (a *Archiver) OnComplete(fn func(Result)) {
+	a.lock("OnComplete")
+	defer a.unlock("OnComplete")
+	a.onComplete = fn
+}
+
+// OnCancel sets a function to be called after a cancelled job has stopped
+// and removed its files.
+func (a *Archiver) OnCancel(fn func(id string)) {
+	a.lock("OnCancel")
+	defer a.unlock("OnCancel")
+	a.onCancel = fn
+}
+
+// OnPhase sets a function to be called after each phase of a job (e.g.
+// "download" or "transcode"), and with the phase "job" when it's done.
+func (a *Archiver) OnPhase(fn func(phase string, elapsed time.Duration, err error)) {
+	a.lock("OnPhase")
+	defer a.unlock("OnPhase")
+	a.onPhase = fn
+}
+
+// phase starts timing a phase of a job; call the returned function with its error when it's done.
+func (a *Archiver) phase(job *Job, name string) func(error) {
+	if name != "job" {
+		a.emit(EventProgress, job, Event{Phase: name})
+	}
+	start := time.Now()
+	return func(err error) {
+		a.rlock("phase")
+		onPhase := a.onPhase
+		a.runlock("phase")
+		if onPhase != nil {
+			onPhase(name, time.Since(start), err)
+		}
+	}
+}
+
+// Heartbeat returns when the manager last checked the queue, which it
+// does at least every 10 seconds while it's alive.
+func (a *Archiver) Heartbeat() time.Time {
+	a.rlock("Heartbeat")
+	defer a.runlock("Heartbeat")
+	return a.heartbeat
+}
+
+// FailedJobs returns the IDs of the jobs that failed since the start.
+func (a *Archiver) FailedJobs() []string {
+	a.rlock("FailedJobs")
+	defer a.runlock("FailedJobs")
+	var ids []string
+	for id := range a.failed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// JobError returns why a job failed, or nil if it didn't.
+func (a *Archiver) JobError(id string) error {
+	a.rlock("JobError")
+	defer a.runlock("JobError")
+	if job, ok := a.failed[id]; ok {
+		return job.err
+	}
+	return nil
+}
+
+// ClearFailed forgets the failed jobs and removes the files they left
+// behind. It returns their IDs.
+func (a *Archiver) ClearFailed() []string {
+	a.lock("ClearFailed")
+	defer a.unlock("ClearFailed")
+	var ids []string
+	for id, job := range a.failed {
+		a.cleanup(job)
+		delete(a.failed, id)
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// SetNormalize enables loudness normalization of newly archived audio.
+func (a *Archiver) SetNormalize(v bool) {
+	a.lock("Normalize")
+	defer a.unlock("Normalize")
+	a.normalize = v
+}
+
+func (a *Archiver) Normalize() bool {
+	a.rlock("Normalize")
+	defer a.runlock("Normalize")
+	return a.normalize
 }
 
 func (a *Archiver) SetConcurrency(n int) {
 	a.lock("Concurrency")
 	defer a.unlock("Concurrency")
 	a.concurrency = n
+	a.wakeup()
 }
 
 func (a *Archiver) Concurrency() int {
@@ -70,14 +275,46 @@ func (a *Archiver) Concurrency() int {
 	return a.concurrency
 }
 
+// SetBandwidth limits the downloads of all jobs together to n bytes per
+// second, 0 for no limit. It applies to running downloads too.
+func (a *Archiver) SetBandwidth(n int64) {
+	a.bandwidth.setRate(n)
+}
+
+func (a *Archiver) Bandwidth() int64 {
+	return a.bandwidth.getRate()
+}
+
+// SetSchedule sets the times of day queued jobs may start. Jobs that are
+// already running when the schedule closes are finished.
+func (a *Archiver) SetSchedule(s Schedule) {
+	a.lock("Schedule")
+	defer a.unlock("Schedule")
+	a.schedule = s
+	a.wakeup()
+}
+
+func (a *Archiver) Schedule() Schedule {
+	a.rlock("Schedule")
+	defer a.runlock("Schedule")
+	return a.schedule
+}
+
+// Paused reports whether queued jobs are waiting for the schedule.
+func (a *Archiver) Paused() bool {
+	a.rlock("Paused")
+	defer a.runlock("Paused")
+	return a.paused
+}
+
+// QueuedJobs returns the IDs of the queued jobs, the next one to start first.
 func (a *Archiver) QueuedJobs() []string {
 	a.rlock("QueuedJobs")
-	defer a.runlock("QueuedJobID")
+	defer a.runlock("QueuedJobs")
 	var ids []string
 	for _, job := range a.queue {
 		ids = append(ids, job.id)
 	}
-	sort.Strings(ids)
 	return ids
 }
 
@@ -106,35 +343,122 @@ func (a *Archiver) InProgress(id string) bool {
 	return false
 }
 
-func (a *Archiver) Remove(id string) {
+// Remove cancels a queued or active job. An active job keeps its place
+// until it has stopped and removed the files it made. It returns false if
+// there's no such job, or it's too late to cancel it.
+func (a *Archiver) Remove(id string) bool {
 	a.lock("Remove")
 	defer a.unlock("Remove")
-	// find job
+	return a.remove(id)
+}
+
+// CancelAll cancels every queued and active job, and returns their IDs.
+func (a *Archiver) CancelAll() []string {
+	a.lock("CancelAll")
+	defer a.unlock("CancelAll")
+	var ids []string
+	for _, job := range a.queue {
+		ids = append(ids, job.id)
+	}
+	for id := range a.active {
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		a.remove(id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (a *Archiver) remove(id string) bool {
+	// Queued jobs haven't made any files yet.
+	for i, job := range a.queue {
+		if job.id == id {
+			a.queue = append(a.queue[:i], a.queue[i+1:]...)
+			job.logger.Infof("archive job %q cancelled", job.id)
+			a.emit(EventCancelled, job, Event{})
+			return true
+		}
+	}
+
+	// Active jobs clean up when they stop.
 	job, ok := a.active[id]
-	if !ok {
-		return
+	if !ok || job.finishing {
+		return false
 	}
-	// cancel it
+	job.cancelled = true
 	cancel := *job.cancel
 	cancel()
-	// remove it
-	delete(a.active, job.id)
+	return true
+}
 
-	return
+// cleanup removes what a job that didn't finish left behind. The image and
+// audio are kept if the media was archived before.
+func (a *Archiver) cleanup(job *Job) {
+	files := []string{job.videofile}
+	if !job.hadAudio {
+		files = append(files, job.imagefile, job.audiofile, job.sourcefile)
+	}
+	for _, f := range files {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			job.logger.Warnf("removing %q failed: %s", f, err)
+		}
+	}
 }
 
-func (a *Archiver) Add(id string, source string) {
+// Add queues a job, after the queued jobs of the same or a higher priority.
+// The requestID (optional) is included in the job's logs and events, to tie
+// them to the request that added it.
+func (a *Archiver) Add(id, source, requestID string, priority Priority) {
 	a.lock("Add")
 	defer a.unlock("Add")
-	// Already running.
-	if _, ok := a.active[id]; ok {
+	// Already running, unless it was cancelled and is still stopping.
+	if job, ok := a.active[id]; ok && !job.cancelled {
 		return
 	}
 	// Already queued.
 	if a.queued(id) {
 		return
 	}
-	a.queue = append(a.queue, a.newJob(id, source))
+	// Tried again.
+	delete(a.failed, id)
+
+	job := a.newJob(id, source, requestID, priority)
+	n := 0
+	for i, queued := range a.queue {
+		if queued.priority <= priority {
+			n = i + 1
+		}
+	}
+	a.queue = append(a.queue[:n], append([]*Job{job}, a.queue[n:]...)...)
+	a.emit(EventQueued, job, Event{})
+	a.wakeup()
+}
+
+// Move puts a queued job at position in the queue, 0 being the next to
+// start, whatever its priority.
+func (a *Archiver) Move(id string, position int) error {
+	a.lock("Move")
+	defer a.unlock("Move")
+	i := -1
+	for n, job := range a.queue {
+		if job.id == id {
+			i = n
+		}
+	}
+	if i < 0 {
+		return ErrNotQueued
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(a.queue)-1 {
+		position = len(a.queue) - 1
+	}
+	job := a.queue[i]
+	a.queue = append(a.queue[:i], a.queue[i+1:]...)
+	a.queue = append(a.queue[:position], append([]*Job{job}, a.queue[position:]...)...)
+	return nil
 }
 
 func (a *Archiver) lock(loc string) {
@@ -165,16 +489,24 @@ func (a *Archiver) runlock(loc string) {
 	a.mu.RUnlock()
 }
 
-func (a *Archiver) newJob(id, source string) *Job {
+func (a *Archiver) newJob(id, source, requestID string, priority Priority) *Job {
 	ctx, cancel := context.WithCancel(context.Background())
+	logger := a.logger.With("job", id)
+	if requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
 	return &Job{
-		id:        id,
-		source:    source,
-		context:   &ctx,
-		cancel:    &cancel,
-		imagefile: filepath.Join(a.datadir, id+".jpg"),
-		videofile: filepath.Join(a.datadir, id+".mp4"),
-		audiofile: filepath.Join(a.datadir, id+".m4a"),
+		id:         id,
+		source:     source,
+		priority:   priority,
+		context:    &ctx,
+		cancel:     &cancel,
+		requestID:  requestID,
+		logger:     logger,
+		imagefile:  filepath.Join(a.datadir, id+".jpg"),
+		videofile:  filepath.Join(a.datadir, id+".mp4"),
+		audiofile:  filepath.Join(a.datadir, id+".m4a"),
+		sourcefile: filepath.Join(a.datadir, id+".source.m4a"),
 	}
 }
 
@@ -188,43 +520,168 @@ func (a *Archiver) queued(id string) bool {
 }
 
 func (a *Archiver) manager() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
 	for {
-		a.lock("manager")
+		a.startJobs()
+		select {
+		case <-a.wake:
+		case <-ticker.C:
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
+// wakeup makes the manager check the queue. It doesn't block, one pending wakeup is enough.
+func (a *Archiver) wakeup() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startJobs starts as many queued jobs as the concurrency and the schedule allow.
+func (a *Archiver) startJobs() {
+	a.lock("startJobs")
+	defer a.unlock("startJobs")
+	a.heartbeat = time.Now()
+
+	if a.debug {
+		a.logger.Debugf("queue: %d active: %d concurrency: %d", len(a.queue), len(a.active), a.concurrency)
+	}
+
+	paused := len(a.queue) > 0 && !a.schedule.Allows(time.Now())
+	if paused != a.paused {
+		if paused {
+			a.logger.Infof("archiver: %d queued jobs wait for the schedule %s", len(a.queue), a.schedule)
+		} else if len(a.queue) > 0 {
+			a.logger.Infof("archiver: the schedule allows starting the queued jobs")
+		}
+		a.paused = paused
+	}
 
-		if a.debug {
-			a.logger.Debugf("queue: %d active: %d concurrency: %d", len(a.queue), len(a.active), a.concurrency)
+	for !a.stopping && !paused && len(a.active) < a.concurrency {
+		// The next job, unless a cancelled job for the same media is still stopping.
+		i := -1
+		for n, job := range a.queue {
+			if _, ok := a.active[job.id]; !ok {
+				i = n
+				break
+			}
+		}
+		if i < 0 {
+			break
 		}
+		job := a.queue[i]
+		a.queue = append(a.queue[:i], a.queue[i+1:]...)
+
+		// Start archiving job.
+		a.active[job.id] = job
+		a.jobs.Add(1)
+		a.emit(EventStarted, job, Event{})
+		go a.archive(job)
+	}
+}
 
-		if len(a.queue) > 0 && len(a.active) < a.concurrency {
-			// Shift off queue.
-			job := a.queue[0]
-			a.queue = a.queue[1:]
+// Shutdown stops starting queued jobs and waits for the active ones to
+// finish. Jobs still running when ctx is done are interrupted, removing
+// their partial files, unless they're already saving their result. It
+// returns the jobs that didn't finish, interrupted ones first.
+func (a *Archiver) Shutdown(ctx context.Context) []PendingJob {
+	a.lock("Shutdown")
+	a.stopping = true
+	a.unlock("Shutdown")
+	defer a.stop()
+
+	// Subscribers never go idle, so they're closed right away.
+	a.events.closeAll()
+
+	done := make(chan struct{})
+	go func() {
+		a.jobs.Wait()
+		close(done)
+	}()
 
-			// Start archiving job.
-			a.active[job.id] = job
-			go a.archive(job)
+	var pending []PendingJob
+	select {
+	case <-done:
+	case <-ctx.Done():
+		a.lock("Shutdown cancel")
+		for _, job := range a.active {
+			if job.finishing || job.cancelled {
+				continue
+			}
+			job.logger.Infof("archive job %q interrupted by shutdown", job.id)
+			job.interrupted = true
+			cancel := *job.cancel
+			cancel()
+			pending = append(pending, PendingJob{ID: job.id, Source: job.source, RequestID: job.requestID, Priority: job.priority})
 		}
-		a.unlock("manager")
+		a.unlock("Shutdown cancel")
+		sort.Slice(pending, func(i, j int) bool {
+			return pending[i].ID < pending[j].ID
+		})
+
+		// Give the interrupted jobs a moment to clean up their files.
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			a.logger.Warnf("archive jobs didn't stop in time")
+		}
+	}
 
-		time.Sleep(2 * time.Second)
+	a.rlock("Shutdown queue")
+	for _, job := range a.queue {
+		pending = append(pending, PendingJob{ID: job.id, Source: job.source, RequestID: job.requestID, Priority: job.priority})
 	}
+	a.runlock("Shutdown queue")
+	return pending
 }
 
 func (a *Archiver) archive(job *Job) {
+	defer a.jobs.Done()
+
 	var failed error
+	jobDone := a.phase(job, "job")
 
 	// Clean up on completion.
 	defer func() {
+		jobDone(failed)
 		a.lock("archive complete")
 		delete(a.active, job.id)
-		if failed != nil {
-			a.logger.Errorf("archive job %q failed: %s", job.id, failed)
-			a.failed[job.id] = failed
+		var onCancel func(string)
+		if job.cancelled {
+			job.logger.Infof("archive job %q cancelled", job.id)
+			a.cleanup(job)
+			a.emit(EventCancelled, job, Event{})
+			onCancel = a.onCancel
+		} else if job.interrupted {
+			// It starts over when it's resumed.
+			a.cleanup(job)
+		} else if failed != nil {
+			job.logger.Errorf("archive job %q failed: %s", job.id, failed)
+			job.err = failed
+			a.failed[job.id] = job
+			a.emit(EventFailed, job, Event{Error: failed.Error()})
+		} else {
+			a.emit(EventCompleted, job, Event{})
 		}
+		a.wakeup()
 		a.unlock("archive complete")
+		if onCancel != nil {
+			onCancel(job.id)
+		}
 	}()
 
+	if _, err := os.Stat(job.audiofile); err == nil {
+		job.hadAudio = true
+	}
+	job.logger.Infof("archive job %q started", job.id)
+
+	done := a.phase(job, "info")
 	vinfo, err := ytdl.GetVideoInfoFromID(job.id)
+	done(err)
 	if err != nil {
 		failed = err
 		return
@@ -234,12 +691,15 @@ func (a *Archiver) archive(job *Job) {
 	imgmax := fmt.Sprintf("https://img.youtube.com/vi/%s/maxresdefault.jpg", vinfo.ID)
 	imgsd := fmt.Sprintf("https://img.youtube.com/vi/%s/hqdefault.jpg", vinfo.ID)
 
-	if maxerr := a.download(*job.context, imgmax, job.imagefile); maxerr != nil {
-		if sderr := a.download(*job.context, imgsd, job.imagefile); sderr != nil {
+	done = a.phase(job, "image")
+	if maxerr := a.download(job, imgmax, job.imagefile); maxerr != nil {
+		if sderr := a.download(job, imgsd, job.imagefile); sderr != nil {
 			failed = fmt.Errorf("max: %s sd: %s", maxerr, sderr)
+			done(failed)
 			return
 		}
 	}
+	done(nil)
 
 	// video
 	videourl, err := vinfo.GetDownloadURL(vinfo.Formats[0])
@@ -250,19 +710,117 @@ func (a *Archiver) archive(job *Job) {
 
 	defer os.Remove(job.videofile)
 
-	if err := a.download(*job.context, videourl.String(), job.videofile); err != nil {
+	done = a.phase(job, "download")
+	err = a.download(job, videourl.String(), job.videofile)
+	done(err)
+	if err != nil {
+		failed = err
+		return
+	}
+
+	// transcode to mp4/aac, finishing processing before the audio file appears.
+	tmpaudio := job.audiofile + ".transcoding"
+	defer os.Remove(tmpaudio)
+
+	done = a.phase(job, "transcode")
+	err = a.transcode(*job.context, job.logger, job.videofile, tmpaudio)
+	done(err)
+	if err != nil {
 		failed = err
 		return
 	}
 
-	// transcode to mp4/aac
-	if err := a.transcode(*job.context, job.videofile, job.audiofile); err != nil {
+	result := Result{ID: job.id}
+
+	// trim leading and trailing silence, keeping the untrimmed audio so it can be re-cut.
+	done = a.phase(job, "trim")
+	start, end, err := DetectSilence(*job.context, tmpaudio)
+	if err != nil {
+		job.logger.Warnf("detecting silence in %q failed: %s", job.id, err)
+	}
+	trimmed := tmpaudio
+	if start > 0 || end > 0 {
+		job.logger.Debugf("trimming %q from %.2f to %.2f", job.id, start, end)
+		trimmed = job.audiofile + ".trimming"
+		defer os.Remove(trimmed)
+		if err := Trim(*job.context, tmpaudio, trimmed, start, end); err != nil {
+			failed = err
+			done(err)
+			return
+		}
+		result.TrimStart = start
+		result.TrimEnd = end
+	}
+	done(nil)
+
+	// loudness of the audio that's played, so the silence that was cut doesn't count.
+	done = a.phase(job, "loudness")
+	loudness, err := MeasureLoudness(*job.context, trimmed)
+	if err != nil {
+		job.logger.Warnf("measuring loudness of %q failed: %s", job.id, err)
+	}
+	if loudness != nil && a.Normalize() {
+		normalized, err := a.normalizeLoudness(*job.context, job.logger, trimmed, loudness)
+		if err != nil {
+			job.logger.Warnf("normalizing %q failed: %s", job.id, err)
+		} else {
+			loudness = normalized
+		}
+	}
+	result.Loudness = loudness
+	done(err)
+
+	// The audio appears last, next to the untrimmed source.
+	if trimmed != tmpaudio {
+		if err := os.Rename(tmpaudio, job.sourcefile); err != nil {
+			failed = err
+			return
+		}
+	}
+	if err := os.Rename(trimmed, job.audiofile); err != nil {
+		if trimmed != tmpaudio {
+			os.Remove(job.sourcefile)
+		}
 		failed = err
 		return
 	}
+
+	if length, err := Duration(*job.context, job.audiofile); err == nil {
+		result.Length = length
+	}
+
+	// chapters, from the container or a tracklist in the description.
+	done = a.phase(job, "chapters")
+	chapters, err := Chapters(*job.context, job.videofile)
+	done(err)
+	if err != nil {
+		job.logger.Warnf("reading chapters of %q failed: %s", job.id, err)
+	}
+	if len(chapters) < 2 {
+		chapters = ParseTracklist(vinfo.Description)
+	}
+	if len(chapters) >= 2 {
+		job.logger.Debugf("found %d chapters in %q", len(chapters), job.id)
+		result.Chapters = chapters
+	}
+
+	// Too late to cancel from here on.
+	a.lock("archive onComplete")
+	if job.cancelled || job.interrupted {
+		a.unlock("archive onComplete")
+		return
+	}
+	job.finishing = true
+	onComplete := a.onComplete
+	a.unlock("archive onComplete")
+	if onComplete != nil {
+		onComplete(result)
+	}
 }
 
-func (a *Archiver) download(ctx context.Context, rawurl, filename string) error {
+func (a *Archiver) download(job *Job, rawurl, filename string) error {
+	ctx := *job.context
+
 	// request file
 	req, err := http.NewRequest("GET", rawurl, nil)
 	if err != nil {
@@ -275,6 +833,7 @@ func (a *Archiver) download(ctx context.Context, rawurl, filename string) error
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		return fmt.Errorf("download %s failed: %s", rawurl, http.StatusText(res.StatusCode))
@@ -288,7 +847,12 @@ func (a *Archiver) download(ctx context.Context, rawurl, filename string) error
 	if err != nil {
 		return err
 	}
-	if _, err := io.Copy(f, res.Body); err != nil {
+	var body io.Reader = &limitedReader{ctx: ctx, r: res.Body, limiter: a.bandwidth}
+	body = &progressReader{r: body, total: res.ContentLength, emit: func(bytes, total int64) {
+		a.emit(EventProgress, job, Event{Phase: "download", Bytes: bytes, Total: total})
+	}}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
 		return err
 	}
 	if err := f.Sync(); err != nil {
@@ -310,7 +874,7 @@ func ffprobe(ctx context.Context, filename string) (*ffprobeInfo, error) {
 		"-i", filename,
 		"-v", "quiet",
 		"-print_format", "json",
-		"-show_format", "-show_streams",
+		"-show_format", "-show_streams", "-show_chapters",
 	)
 
 	output, err := cmd.CombinedOutput()
@@ -325,7 +889,7 @@ func ffprobe(ctx context.Context, filename string) (*ffprobeInfo, error) {
 	return &ffinfo, nil
 }
 
-func (a *Archiver) transcode(ctx context.Context, videofile, audioFile string) error {
+func (a *Archiver) transcode(ctx context.Context, logger *zap.SugaredLogger, videofile, audioFile string) error {
 	ffmpeg, err := exec.LookPath("ffmpeg")
 	if err != nil {
 		return err
@@ -344,7 +908,7 @@ func (a *Archiver) transcode(ctx context.Context, videofile, audioFile string) e
 			typ := stream.CodecType
 			name := stream.CodecName
 
-			a.logger.Debugf("stream #%d %q codec is %q", i, typ, name)
+			logger.Debugf("stream #%d %q codec is %q", i, typ, name)
 
 			if typ == "audio" && name == "aac" {
 				audioCodec = "copy"
@@ -363,7 +927,7 @@ func (a *Archiver) transcode(ctx context.Context, videofile, audioFile string) e
 			"-f", "mp4",
 			tmpname,
 		}
-		a.logger.Debugf("transcoding with %s %s", ffmpeg, strings.Join(args, " "))
+		logger.Debugf("transcoding with %s %s", ffmpeg, strings.Join(args, " "))
 
 		output, err := exec.CommandContext(ctx, ffmpeg, args...).CombinedOutput()
 		if err != nil {
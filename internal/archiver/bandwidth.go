@@ -0,0 +1,93 @@
+package archiver
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// limiter shares a download rate between all the jobs' downloads.
+type limiter struct {
+	mu   sync.Mutex
+	rate int64 // bytes per second, 0 is unlimited
+
+	// Bytes that can be read right away; negative when readers are waiting.
+	tokens float64
+	last   time.Time
+}
+
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+func (l *limiter) getRate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// chunk is how much to read at once, so a slow rate isn't used up in one go.
+func (l *limiter) chunk() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate > 0 && l.rate < 32*1024 {
+		return int(l.rate)
+	}
+	return 32 * 1024
+}
+
+// wait takes n bytes from the rate, waiting until they're available.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	// At most a second's worth of bursting.
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// limitedReader reads at the limiter's rate.
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *limiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	if n := r.limiter.chunk(); len(p) > n {
+		p = p[:n]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := r.limiter.wait(r.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,76 @@
+package archiver
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// A timestamp such as "1:23", "01:02:03" or "[4:56]" at a word boundary.
+	timestampRegexp = regexp.MustCompile(`(?:^|[\s\[\(])((?:\d{1,2}:)?\d{1,2}:\d{2})(?:[\]\)]|\s|$)`)
+
+	// Leading track numbers and separators around chapter titles.
+	tracknumberRegexp = regexp.MustCompile(`^\d{1,3}[.)]\s+`)
+	titleCutset       = " \t-–—|:.,()[]"
+)
+
+// Chapter is a section of a media file, such as one song of an album upload.
+type Chapter struct {
+	Title string
+	Start float64 // In seconds
+	End   float64 // In seconds, 0 is the end
+}
+
+// Chapters returns the chapter markers stored in a media file.
+func Chapters(ctx context.Context, filename string) ([]Chapter, error) {
+	ffinfo, err := ffprobe(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	var chapters []Chapter
+	for _, c := range ffinfo.Chapters {
+		start, err := strconv.ParseFloat(c.StartTime, 64)
+		if err != nil {
+			return nil, err
+		}
+		end, err := strconv.ParseFloat(c.EndTime, 64)
+		if err != nil {
+			return nil, err
+		}
+		chapters = append(chapters, Chapter{Title: c.Tags.Title, Start: start, End: end})
+	}
+	return chapters, nil
+}
+
+// ParseTracklist finds a tracklist of timestamped lines in text, such as a
+// video description. It returns nil unless there are at least two tracks.
+func ParseTracklist(text string) []Chapter {
+	var chapters []Chapter
+	for _, line := range strings.Split(text, "\n") {
+		m := timestampRegexp.FindStringSubmatchIndex(line)
+		if m == nil {
+			continue
+		}
+		start, err := ParseTimestamp(line[m[2]:m[3]])
+		if err != nil {
+			continue
+		}
+		// Out of order, so it's probably not part of the tracklist.
+		if len(chapters) > 0 && start <= chapters[len(chapters)-1].Start {
+			continue
+		}
+
+		title := strings.Trim(line[:m[2]]+" "+line[m[3]:], titleCutset)
+		title = strings.Trim(tracknumberRegexp.ReplaceAllString(title, ""), titleCutset)
+		chapters = append(chapters, Chapter{Title: title, Start: start})
+	}
+	if len(chapters) < 2 {
+		return nil
+	}
+	for i := 0; i < len(chapters)-1; i++ {
+		chapters[i].End = chapters[i+1].Start
+	}
+	return chapters
+}
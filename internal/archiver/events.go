@@ -0,0 +1,138 @@
+package archiver
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Events sent to subscribers.
+const (
+	EventQueued    = "queued"
+	EventStarted   = "started"
+	EventProgress  = "progress"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventCancelled = "cancelled"
+)
+
+// Events a subscriber can fall behind by before it's dropped.
+const subscriptionBuffer = 256
+
+// Event is something that happened to a job.
+type Event struct {
+	Type      string    `json:"type"` // one of the Event constants
+	Job       string    `json:"job"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id,omitempty"`
+
+	// Progress: the phase the job started (e.g. "download"), or how much of
+	// the download is done. Total is 0 when the size isn't known.
+	Phase string `json:"phase,omitempty"`
+	Bytes int64  `json:"bytes,omitempty"`
+	Total int64  `json:"total,omitempty"`
+
+	// Failed
+	Error string `json:"error,omitempty"`
+}
+
+// Subscription receives the events that happen after it subscribed.
+type Subscription struct {
+	hub    *hub
+	events chan Event
+	done   chan struct{}
+}
+
+// Events receives each event.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Done is closed when the subscription is closed, or dropped for falling behind.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscription) Close() {
+	s.hub.Lock()
+	defer s.hub.Unlock()
+	s.hub.unsubscribe(s)
+}
+
+// hub has its own lock, so events can be sent with or without the archiver's.
+type hub struct {
+	sync.Mutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// Subscribe registers a new subscription to the jobs' events. It must be
+// closed when it's no longer needed.
+func (a *Archiver) Subscribe() *Subscription {
+	a.events.Lock()
+	defer a.events.Unlock()
+	s := &Subscription{
+		hub:    &a.events,
+		events: make(chan Event, subscriptionBuffer),
+		done:   make(chan struct{}),
+	}
+	a.events.subscriptions[s] = struct{}{}
+	return s
+}
+
+// emit sends an event to every subscription. Subscriptions that fall behind
+// are dropped, so a slow one can't hold up the jobs.
+func (a *Archiver) emit(typ string, job *Job, e Event) {
+	e.Type = typ
+	e.Job = job.id
+	e.RequestID = job.requestID
+	e.Time = time.Now()
+
+	a.events.Lock()
+	defer a.events.Unlock()
+	for s := range a.events.subscriptions {
+		select {
+		case s.events <- e:
+		default:
+			a.events.unsubscribe(s)
+		}
+	}
+}
+
+func (h *hub) closeAll() {
+	h.Lock()
+	defer h.Unlock()
+	for s := range h.subscriptions {
+		h.unsubscribe(s)
+	}
+}
+
+func (h *hub) unsubscribe(s *Subscription) {
+	if _, ok := h.subscriptions[s]; !ok {
+		return
+	}
+	delete(h.subscriptions, s)
+	close(s.done)
+}
+
+// progressReader reports how much has been read, at most once a second.
+type progressReader struct {
+	r     io.Reader
+	total int64 // -1 if it isn't known
+	emit  func(bytes, total int64)
+	bytes int64
+	last  time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.bytes += int64(n)
+	if err == io.EOF || time.Since(p.last) >= time.Second {
+		p.last = time.Now()
+		total := p.total
+		if total < 0 {
+			total = 0
+		}
+		p.emit(p.bytes, total)
+	}
+	return n, err
+}
@@ -75,4 +75,12 @@ type ffprobeInfo struct {
 		TimeBase string `json:"time_base"`
 		Width    int    `json:"width"`
 	} `json:"streams"`
+	Chapters []struct {
+		ID        int    `json:"id"`
+		StartTime string `json:"start_time"`
+		EndTime   string `json:"end_time"`
+		Tags      struct {
+			Title string `json:"title"`
+		} `json:"tags"`
+	} `json:"chapters"`
 }
@@ -0,0 +1,151 @@
+package archiver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// EBU R128 normalization target.
+	TargetLoudness = -16.0 // LUFS
+	TargetTruePeak = -1.5  // dBTP
+	TargetRange    = 11.0  // LU
+
+	// ReplayGain 2.0 reference level.
+	ReplayGainReference = -18.0 // LUFS
+)
+
+// Loudness is an EBU R128 measurement of an audio file.
+type Loudness struct {
+	Integrated float64 // LUFS
+	TruePeak   float64 // dBTP
+	Range      float64 // LU
+	Threshold  float64 // LUFS
+	Offset     float64 // LU
+}
+
+// TrackGain is the ReplayGain track gain in dB.
+func (l Loudness) TrackGain() float64 {
+	return ReplayGainReference - l.Integrated
+}
+
+// TrackPeak is the ReplayGain track peak as a linear sample value.
+func (l Loudness) TrackPeak() float64 {
+	return dbToLinear(l.TruePeak)
+}
+
+type loudnormInfo struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	OutputI      string `json:"output_i"`
+	OutputTP     string `json:"output_tp"`
+	OutputLRA    string `json:"output_lra"`
+	OutputThresh string `json:"output_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// MeasureLoudness runs a loudnorm analysis pass over filename.
+func MeasureLoudness(ctx context.Context, filename string) (*Loudness, error) {
+	filter := fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=%.1f:print_format=json", TargetLoudness, TargetTruePeak, TargetRange)
+	info, err := loudnorm(ctx, filename, filter, "-f", "null", "-")
+	if err != nil {
+		return nil, err
+	}
+	return parseLoudness(info.InputI, info.InputTP, info.InputLRA, info.InputThresh, info.TargetOffset)
+}
+
+func (a *Archiver) normalizeLoudness(ctx context.Context, logger *zap.SugaredLogger, filename string, measured *Loudness) (*Loudness, error) {
+	filter := fmt.Sprintf(
+		"loudnorm=I=%.1f:TP=%.1f:LRA=%.1f:measured_I=%.2f:measured_TP=%.2f:measured_LRA=%.2f:measured_thresh=%.2f:offset=%.2f:linear=true:print_format=json",
+		TargetLoudness, TargetTruePeak, TargetRange,
+		measured.Integrated, measured.TruePeak, measured.Range, measured.Threshold, measured.Offset,
+	)
+
+	tmpname := filename + ".normalizing"
+	defer os.Remove(tmpname)
+
+	logger.Debugf("normalizing %q with %s", filename, filter)
+	info, err := loudnorm(ctx, filename, filter,
+		"-c:a", "aac",
+		"-b:a", "192k",
+		"-movflags", "faststart",
+		"-f", "mp4",
+		tmpname,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpname, filename); err != nil {
+		return nil, err
+	}
+	return parseLoudness(info.OutputI, info.OutputTP, info.OutputLRA, info.OutputThresh, info.TargetOffset)
+}
+
+// loudnorm runs ffmpeg with a loudnorm filter and parses the JSON summary it prints.
+func loudnorm(ctx context.Context, filename, filter string, output ...string) (*loudnormInfo, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"-y", "-hide_banner", "-nostats", "-i", filename, "-vn", "-af", filter}
+	args = append(args, output...)
+
+	out, err := exec.CommandContext(ctx, ffmpeg, args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("loudnorm %q failed: %s\n%s", filename, err, string(out))
+	}
+
+	// The summary is the last JSON object in the output.
+	s := string(out)
+	start := strings.LastIndex(s, "{")
+	end := strings.LastIndex(s, "}")
+	if start == -1 || end < start {
+		return nil, fmt.Errorf("loudnorm %q: no summary found", filename)
+	}
+
+	var info loudnormInfo
+	if err := json.Unmarshal([]byte(s[start:end+1]), &info); err != nil {
+		return nil, fmt.Errorf("loudnorm %q: %s", filename, err)
+	}
+	return &info, nil
+}
+
+func parseLoudness(integrated, truepeak, lra, thresh, offset string) (*Loudness, error) {
+	var l Loudness
+	for _, v := range []struct {
+		s string
+		f *float64
+	}{
+		{integrated, &l.Integrated},
+		{truepeak, &l.TruePeak},
+		{lra, &l.Range},
+		{thresh, &l.Threshold},
+		{offset, &l.Offset},
+	} {
+		n, err := strconv.ParseFloat(strings.TrimSpace(v.s), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loudness value %q: %s", v.s, err)
+		}
+		// Silence measures as -inf.
+		if math.IsInf(n, 0) || math.IsNaN(n) {
+			return nil, fmt.Errorf("unmeasurable loudness value %q", v.s)
+		}
+		*v.f = n
+	}
+	return &l, nil
+}
+
+func dbToLinear(db float64) float64 {
+	return math.Pow(10, db/20)
+}
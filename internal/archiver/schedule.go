@@ -0,0 +1,79 @@
+package archiver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is the times of day jobs may start, e.g. "22:00-06:00" to only
+// download at night. An empty schedule allows any time.
+type Schedule []Window
+
+// Window is a time of day range, in minutes after midnight. It wraps past
+// midnight when End is before Start.
+type Window struct {
+	Start int
+	End   int
+}
+
+// ParseSchedule parses comma separated ranges like "22:00-06:00,12:00-13:30", in local time.
+func ParseSchedule(s string) (Schedule, error) {
+	var schedule Schedule
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		times := strings.Split(part, "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("invalid schedule %q: expected a range like 22:00-06:00", part)
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s", part, err)
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s", part, err)
+		}
+		if start == end {
+			return nil, fmt.Errorf("invalid schedule %q: the range is empty", part)
+		}
+		schedule = append(schedule, Window{Start: start, End: end})
+	}
+	return schedule, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("%q isn't a time like 06:00", strings.TrimSpace(s))
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Allows reports whether t is in one of the schedule's windows.
+func (s Schedule) Allows(t time.Time) bool {
+	if len(s) == 0 {
+		return true
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, w := range s {
+		if w.Start < w.End && minute >= w.Start && minute < w.End {
+			return true
+		}
+		if w.Start > w.End && (minute >= w.Start || minute < w.End) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s Schedule) String() string {
+	var parts []string
+	for _, w := range s {
+		parts = append(parts, fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60))
+	}
+	return strings.Join(parts, ",")
+}
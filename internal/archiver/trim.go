@@ -0,0 +1,127 @@
+package archiver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// Silence is anything quieter than SilenceNoise for at least SilenceDuration seconds.
+	SilenceNoise    = "-50dB"
+	SilenceDuration = 0.5
+
+	// Silence within this many seconds of either end counts as leading or trailing.
+	silenceSlack = 0.1
+
+	silenceStartRegexp = regexp.MustCompile(`silence_start: (-?[0-9.]+)`)
+	silenceEndRegexp   = regexp.MustCompile(`silence_end: (-?[0-9.]+)`)
+)
+
+// Duration returns the length of a media file in seconds.
+func Duration(ctx context.Context, filename string) (float64, error) {
+	ffinfo, err := ffprobe(ctx, filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(ffinfo.Format.Duration, 64)
+}
+
+// DetectSilence finds leading and trailing silence in filename. It returns the
+// position where the sound starts, and where it ends (0 if it runs to the end).
+func DetectSilence(ctx context.Context, filename string) (start, end float64, err error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return 0, 0, err
+	}
+	duration, err := Duration(ctx, filename)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	filter := fmt.Sprintf("silencedetect=noise=%s:d=%.2f", SilenceNoise, SilenceDuration)
+	output, err := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-nostats", "-i", filename, "-vn", "-af", filter, "-f", "null", "-").CombinedOutput()
+	if err != nil {
+		return 0, 0, fmt.Errorf("silencedetect %q failed: %s\n%s", filename, err, string(output))
+	}
+
+	// Pair up the reported silences; the last one may run to the end without a silence_end.
+	var silences [][2]float64
+	for _, line := range strings.Split(string(output), "\n") {
+		if m := silenceStartRegexp.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.ParseFloat(m[1], 64)
+			silences = append(silences, [2]float64{n, duration})
+		}
+		if m := silenceEndRegexp.FindStringSubmatch(line); m != nil && len(silences) > 0 {
+			n, _ := strconv.ParseFloat(m[1], 64)
+			silences[len(silences)-1][1] = n
+		}
+	}
+
+	for _, s := range silences {
+		// All silent, so leave it alone.
+		if s[0] <= silenceSlack && s[1] >= duration-silenceSlack {
+			return 0, 0, nil
+		}
+		if s[0] <= silenceSlack {
+			start = s[1]
+		}
+		if s[1] >= duration-silenceSlack {
+			end = s[0]
+		}
+	}
+	return start, end, nil
+}
+
+// Trim cuts source from start to end (0 for the end) into dest, without re-encoding.
+func Trim(ctx context.Context, source, dest string, start, end float64) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return err
+	}
+	if end != 0 && end <= start {
+		return fmt.Errorf("invalid trim: end %.2f is before start %.2f", end, start)
+	}
+
+	tmpname := dest + ".transcoding"
+	defer os.Remove(tmpname)
+
+	args := []string{"-y", "-i", source, "-ss", fmt.Sprintf("%.3f", start)}
+	if end != 0 {
+		args = append(args, "-to", fmt.Sprintf("%.3f", end))
+	}
+	args = append(args,
+		"-vn",
+		"-c:a", "copy",
+		"-movflags", "faststart",
+		"-f", "mp4",
+		tmpname,
+	)
+
+	output, err := exec.CommandContext(ctx, ffmpeg, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("trimming %q to %q failed: %s\n%s", source, dest, err, string(output))
+	}
+	return os.Rename(tmpname, dest)
+}
+
+// ParseTimestamp parses "90", "90.5", "1:30" or "1:01:30" into seconds.
+func ParseTimestamp(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0, nil
+	}
+	var seconds float64
+	for _, part := range strings.Split(s, ":") {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds, nil
+}
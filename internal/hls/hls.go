@@ -0,0 +1,171 @@
+package hls
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Rendition is one bitrate variant of an HLS stream.
+type Rendition struct {
+	Name    string
+	Bitrate int // In bits per second
+}
+
+var (
+	// Renditions are the variants advertised in the master playlist, lowest first.
+	Renditions = []Rendition{
+		{Name: "64k", Bitrate: 64000},
+		{Name: "128k", Bitrate: 128000},
+		{Name: "192k", Bitrate: 192000},
+	}
+
+	// SegmentDuration is the target length of each segment in seconds.
+	SegmentDuration = 10
+
+	// How often a request waiting for the first segment checks for it.
+	livePoll = 250 * time.Millisecond
+)
+
+// Segmenter lazily segments audio files into HLS renditions using ffmpeg.
+// Each rendition is segmented once and cached on disk, and can be played
+// while it's being segmented.
+type Segmenter struct {
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+	errors  map[string]error
+	logger  *zap.SugaredLogger
+}
+
+func NewSegmenter(logger *zap.SugaredLogger) *Segmenter {
+	return &Segmenter{
+		pending: make(map[string]chan struct{}),
+		errors:  make(map[string]error),
+		logger:  logger,
+	}
+}
+
+func FindRendition(name string) (Rendition, bool) {
+	for _, r := range Renditions {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Rendition{}, false
+}
+
+// WriteMaster writes the master playlist listing every rendition.
+func WriteMaster(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "#EXTM3U\n#EXT-X-VERSION:3\n"); err != nil {
+		return err
+	}
+	for _, r := range Renditions {
+		// Allow for container overhead in the advertised bandwidth.
+		bandwidth := r.Bitrate + r.Bitrate/10
+		if _, err := fmt.Fprintf(w, "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"mp4a.40.2\"\n%s.m3u8\n", bandwidth, r.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Playlist returns the rendition playlist for audiofile in dir, segmenting
+// the audio first if it hasn't been done yet. While that's running, it's an
+// EVENT playlist of the segments written so far, which players reload until
+// it ends, so playback starts with the first segment.
+func (s *Segmenter) Playlist(ctx context.Context, audiofile, dir string, rendition Rendition) ([]byte, error) {
+	playlist := filepath.Join(dir, rendition.Name+".m3u8")
+	if b, err := ioutil.ReadFile(playlist); err == nil {
+		return b, nil
+	}
+	live := playlist + ".segmenting"
+
+	s.mu.Lock()
+	done, ok := s.pending[playlist]
+	if !ok {
+		done = make(chan struct{})
+		s.pending[playlist] = done
+		delete(s.errors, playlist)
+
+		// Left behind by an interrupted run.
+		os.Remove(live)
+
+		// Segment in the background so an impatient client doesn't waste the work.
+		go func() {
+			err := s.segment(audiofile, dir, live, playlist, rendition)
+			s.mu.Lock()
+			delete(s.pending, playlist)
+			if err != nil {
+				s.logger.Errorf("segmenting %q failed: %s", playlist, err)
+				s.errors[playlist] = err
+			}
+			s.mu.Unlock()
+			close(done)
+		}()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(livePoll)
+	defer ticker.Stop()
+	for {
+		// ffmpeg writes the playlist once the first segment is done.
+		if b, err := ioutil.ReadFile(live); err == nil {
+			return b, nil
+		}
+		select {
+		case <-done:
+			s.mu.Lock()
+			err := s.errors[playlist]
+			s.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.ReadFile(playlist)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// segment writes the growing playlist to live, and moves it to playlist when it's complete.
+func (s *Segmenter) segment(audiofile, dir, live, playlist string, rendition Rendition) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	defer os.Remove(live)
+
+	args := []string{
+		"-y", "-i", audiofile,
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", rendition.Name,
+		"-f", "hls",
+		"-hls_time", fmt.Sprintf("%d", SegmentDuration),
+		"-hls_list_size", "0",
+		"-hls_playlist_type", "event",
+		"-hls_segment_filename", filepath.Join(dir, rendition.Name+"-%05d.ts"),
+		live,
+	}
+	s.logger.Debugf("segmenting with %s %s", ffmpeg, strings.Join(args, " "))
+
+	output, err := exec.Command(ffmpeg, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("segmenting %q failed: %s\n%s", audiofile, err, string(output))
+	}
+	return os.Rename(live, playlist)
+}
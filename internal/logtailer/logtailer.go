@@ -1,15 +1,32 @@
 package logtailer
 
 import (
-	"github.com/armon/circbuf"
+	"fmt"
+	"os"
 	"strings"
 	"sync"
+
+	"github.com/armon/circbuf"
 )
 
+// Number of lines buffered per subscriber before it's considered too slow.
+const subscriberBuffer = 1024
+
 type Logtailer struct {
 	sync.RWMutex
 
 	tail *circbuf.Buffer
+
+	// the end of the last write, if it wasn't a whole line
+	partial     string
+	subscribers map[*Subscriber]struct{}
+
+	// persisted log file, if any
+	file     *os.File
+	filename string
+	size     int64
+	maxSize  int64
+	keep     int
 }
 
 func NewLogtailer(size int64) (*Logtailer, error) {
@@ -17,7 +34,7 @@ func NewLogtailer(size int64) (*Logtailer, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Logtailer{tail: buf}, nil
+	return &Logtailer{tail: buf, subscribers: make(map[*Subscriber]struct{})}, nil
 }
 
 func (l *Logtailer) Lines() []string {
@@ -35,11 +52,193 @@ func (l *Logtailer) Lines() []string {
 
 func (l *Logtailer) Write(buf []byte) (int, error) {
 	l.Lock()
+	defer l.Unlock()
+
 	n, err := l.tail.Write(buf)
-	l.Unlock()
+	if l.file != nil {
+		l.persist(buf)
+	}
+
+	// Subscribers only get whole lines.
+	s := l.partial + string(buf)
+	nl := strings.LastIndex(s, "\n")
+	if nl == -1 {
+		l.partial = s
+		return n, err
+	}
+	l.partial = s[nl+len("\n"):]
+	for _, line := range strings.Split(s[:nl], "\n") {
+		l.broadcast(line)
+	}
 	return n, err
 }
 
 func (l *Logtailer) Sync() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.file != nil {
+		return l.file.Sync()
+	}
+	return nil
+}
+
+//
+// Subscribers
+//
+
+// Subscriber receives the lines written after it subscribed.
+type Subscriber struct {
+	logtail *Logtailer
+	lines   chan string
+	done    chan struct{}
+}
+
+// Subscribe registers a new subscriber. It must be closed when it's no longer needed.
+func (l *Logtailer) Subscribe() *Subscriber {
+	l.Lock()
+	defer l.Unlock()
+	s := &Subscriber{
+		logtail: l,
+		lines:   make(chan string, subscriberBuffer),
+		done:    make(chan struct{}),
+	}
+	l.subscribers[s] = struct{}{}
+	return s
+}
+
+// Lines receives each new line, without its newline.
+func (s *Subscriber) Lines() <-chan string {
+	return s.lines
+}
+
+// Done is closed when the subscriber is closed, or dropped for falling behind.
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *Subscriber) Close() {
+	s.logtail.Lock()
+	defer s.logtail.Unlock()
+	s.logtail.unsubscribe(s)
+}
+
+// CloseSubscribers closes every subscriber, e.g. when shutting down.
+func (l *Logtailer) CloseSubscribers() {
+	l.Lock()
+	defer l.Unlock()
+	for s := range l.subscribers {
+		l.unsubscribe(s)
+	}
+}
+
+func (l *Logtailer) unsubscribe(s *Subscriber) {
+	if _, ok := l.subscribers[s]; !ok {
+		return
+	}
+	delete(l.subscribers, s)
+	close(s.done)
+}
+
+// broadcast sends a line to every subscriber. It can't block (or log), so
+// subscribers that fall behind are dropped.
+func (l *Logtailer) broadcast(line string) {
+	for s := range l.subscribers {
+		select {
+		case s.lines <- line:
+		default:
+			l.unsubscribe(s)
+		}
+	}
+}
+
+//
+// Log files
+//
+
+// Persist also writes the log to filename, rotating it when it grows past
+// maxSize and keeping the keep most recent rotated files (filename.1 being
+// the most recent).
+func (l *Logtailer) Persist(filename string, maxSize int64, keep int) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	l.filename = filename
+	l.size = fi.Size()
+	l.maxSize = maxSize
+	l.keep = keep
+	return nil
+}
+
+// Files returns the persisted log files that exist, the current one first.
+func (l *Logtailer) Files() []string {
+	l.RLock()
+	filename, keep := l.filename, l.keep
+	l.RUnlock()
+
+	if filename == "" {
+		return nil
+	}
+	var files []string
+	for i := 0; i <= keep; i++ {
+		name := rotatedName(filename, i)
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+func (l *Logtailer) persist(buf []byte) {
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(buf)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			// The logger is what's failing, so stderr is all that's left.
+			fmt.Fprintf(os.Stderr, "logtailer: rotating %s failed: %s\n", l.filename, err)
+		}
+		if l.file == nil {
+			return
+		}
+	}
+	n, err := l.file.Write(buf)
+	l.size += int64(n)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "logtailer: writing %s failed: %s\n", l.filename, err)
+	}
+}
+
+func (l *Logtailer) rotate() error {
+	l.file.Close()
+	l.file = nil
+	os.Remove(rotatedName(l.filename, l.keep))
+	for i := l.keep - 1; i >= 0; i-- {
+		if err := os.Rename(rotatedName(l.filename, i), rotatedName(l.filename, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	l.file = f
+	l.size = 0
 	return nil
 }
+
+func rotatedName(filename string, i int) string {
+	if i == 0 {
+		return filename
+	}
+	return fmt.Sprintf("%s.%d", filename, i)
+}
@@ -0,0 +1,269 @@
+// Package metrics keeps counters, gauges and histograms and serves them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// DefaultBuckets are histogram buckets for request latencies, in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry is a set of metrics. Metrics are created with it and written in
+// the order they were created.
+type Registry struct {
+	mu        sync.Mutex
+	metrics   []metric
+	onCollect []func()
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// OnCollect adds a function that's called before each scrape, to set the
+// gauges that are cheaper to compute when they're needed.
+func (r *Registry) OnCollect(fn func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onCollect = append(r.onCollect, fn)
+}
+
+func (r *Registry) add(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// Write writes all the metrics in the text exposition format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	onCollect := append([]func(){}, r.onCollect...)
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	for _, fn := range onCollect {
+		fn()
+	}
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.Write(w)
+}
+
+// desc is what a metric is, and the labels its samples have.
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d desc) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, strings.Replace(d.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.typ)
+}
+
+// key identifies a sample by its label values.
+func (d desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has labels %v, got values %v", d.name, d.labels, values))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString formats the labels, with any extra ones (e.g. le) at the end.
+func (d desc) labelString(values []string, extra ...string) string {
+	var pairs []string
+	for i, l := range d.labels {
+		pairs = append(pairs, l+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// values is the samples of a counter or gauge, by key.
+type values struct {
+	desc
+	mu      sync.Mutex
+	samples map[string]float64
+	byKey   map[string][]string // the label values of each sample
+}
+
+func newValues(d desc) *values {
+	return &values{desc: d, samples: make(map[string]float64), byKey: make(map[string][]string)}
+}
+
+func (v *values) update(fn func(float64) float64, labelValues []string) {
+	k := v.key(labelValues)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.byKey[k]; !ok {
+		v.byKey[k] = append([]string{}, labelValues...)
+	}
+	v.samples[k] = fn(v.samples[k])
+}
+
+func (v *values) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.header(w)
+	keys := make([]string, 0, len(v.samples))
+	for k := range v.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelString(v.byKey[k]), formatFloat(v.samples[k]))
+	}
+}
+
+// Counter only goes up, e.g. requests served.
+type Counter struct {
+	*values
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newValues(desc{name, help, "counter", labels})}
+	r.add(c)
+	return c
+}
+
+func (c *Counter) Add(n float64, labelValues ...string) {
+	if n < 0 {
+		panic("metrics: counters can't go down")
+	}
+	c.update(func(v float64) float64 { return v + n }, labelValues)
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Set is for totals that are counted elsewhere, e.g. by the Go runtime.
+func (c *Counter) Set(n float64, labelValues ...string) {
+	c.update(func(float64) float64 { return n }, labelValues)
+}
+
+// Gauge goes up and down, e.g. queued jobs.
+type Gauge struct {
+	*values
+}
+
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newValues(desc{name, help, "gauge", labels})}
+	r.add(g)
+	return g
+}
+
+func (g *Gauge) Set(n float64, labelValues ...string) {
+	g.update(func(float64) float64 { return n }, labelValues)
+}
+
+func (g *Gauge) Add(n float64, labelValues ...string) {
+	g.update(func(v float64) float64 { return v + n }, labelValues)
+}
+
+// Histogram counts observations (e.g. durations) in buckets.
+type Histogram struct {
+	desc
+	buckets []float64
+
+	mu      sync.Mutex
+	samples map[string]*histogramSample
+}
+
+type histogramSample struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	buckets = append([]float64{}, buckets...)
+	sort.Float64s(buckets)
+	h := &Histogram{
+		desc:    desc{name, help, "histogram", labels},
+		buckets: buckets,
+		samples: make(map[string]*histogramSample),
+	}
+	r.add(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	k := h.key(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.samples[k]
+	if !ok {
+		s = &histogramSample{labels: append([]string{}, labelValues...), counts: make([]uint64, len(h.buckets))}
+		h.samples[k] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	keys := make([]string, 0, len(h.samples))
+	for k := range h.samples {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := h.samples[k]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labels, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(s.labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(s.labels), s.count)
+	}
+}
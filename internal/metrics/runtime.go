@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"runtime"
+	"time"
+)
+
+// RegisterRuntime adds the Go runtime's goroutine, memory and garbage
+// collector stats, under the names the Prometheus Go client uses.
+func RegisterRuntime(r *Registry) {
+	info := r.NewGauge("go_info", "Information about the Go environment.", "version")
+	goroutines := r.NewGauge("go_goroutines", "Number of goroutines that currently exist.")
+	threads := r.NewGauge("go_threads", "Number of OS threads created.")
+	alloc := r.NewGauge("go_memstats_alloc_bytes", "Number of bytes allocated and still in use.")
+	allocTotal := r.NewCounter("go_memstats_alloc_bytes_total", "Total number of bytes allocated, even if freed.")
+	sys := r.NewGauge("go_memstats_sys_bytes", "Number of bytes obtained from the system.")
+	heapInuse := r.NewGauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.")
+	heapObjects := r.NewGauge("go_memstats_heap_objects", "Number of allocated objects.")
+	gcCount := r.NewCounter("go_gc_cycles_total", "Number of completed GC cycles.")
+	gcPause := r.NewCounter("go_gc_pause_seconds_total", "Total time the GC has stopped the world.")
+	lastGC := r.NewGauge("go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of the last garbage collection.")
+	start := r.NewGauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.")
+
+	info.Set(1, runtime.Version())
+	start.Set(float64(time.Now().UnixNano()) / 1e9)
+
+	r.OnCollect(func() {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		n, _ := runtime.ThreadCreateProfile(nil)
+
+		goroutines.Set(float64(runtime.NumGoroutine()))
+		threads.Set(float64(n))
+		alloc.Set(float64(m.Alloc))
+		allocTotal.Set(float64(m.TotalAlloc))
+		sys.Set(float64(m.Sys))
+		heapInuse.Set(float64(m.HeapInuse))
+		heapObjects.Set(float64(m.HeapObjects))
+		gcCount.Set(float64(m.NumGC))
+		gcPause.Set(float64(m.PauseTotalNs) / 1e9)
+		lastGC.Set(float64(m.LastGC) / 1e9)
+	})
+}
@@ -0,0 +1,240 @@
+// Command mockissuer is a local OpenID Connect provider for trying out the
+// SSO login. It signs in anybody, as whoever they say they are.
+//
+//	go run internal/oidc/cmd/mockissuer.go -addr :9000
+//	soundscape --oidc-issuer http://localhost:9000 --oidc-client-id soundscape --oidc-admin-group admins ...
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	addr     = flag.String("addr", ":9000", "listen address")
+	issuer   = flag.String("issuer", "http://localhost:9000", "issuer URL")
+	clientID = flag.String("client-id", "soundscape", "client id")
+	user     = flag.String("user", "alice", "default username")
+	groups   = flag.String("groups", "admins", "default groups (comma separated)")
+
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes = make(map[string]grant)
+
+	authorizeHTML = template.Must(template.New("authorize").Parse(`
+        <html>
+            <head><title>Mock Issuer</title></head>
+            <body>
+                <h2>Sign in to {{.ClientID}}</h2>
+                <form method="POST">
+                    {{range $k, $v := .Params}}<input type="hidden" name="{{$k}}" value="{{index $v 0}}">{{end}}
+                    <p><label>Username <input name="username" value="{{.User}}"></label></p>
+                    <p><label>Groups <input name="groups" value="{{.Groups}}"></label></p>
+                    <button type="submit">Sign in</button>
+                </form>
+            </body>
+        </html>
+    `))
+)
+
+type grant struct {
+	redirect  string
+	challenge string
+	nonce     string
+	username  string
+	groups    []string
+	expires   time.Time
+}
+
+func main() {
+	flag.Parse()
+
+	var err error
+	key, err = rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", discovery)
+	http.HandleFunc("/authorize", authorize)
+	http.HandleFunc("/token", token)
+	http.HandleFunc("/jwks", jwks)
+
+	log.Printf("mock issuer %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
+
+func discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                *issuer,
+		"authorization_endpoint":                *issuer + "/authorize",
+		"token_endpoint":                        *issuer + "/token",
+		"jwks_uri":                              *issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func authorize(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("client_id") != *clientID {
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	if r.FormValue("code_challenge_method") != "S256" || r.FormValue("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(r.FormValue("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		authorizeHTML.Execute(w, map[string]interface{}{
+			"ClientID": *clientID,
+			"Params":   r.URL.Query(),
+			"User":     *user,
+			"Groups":   *groups,
+		})
+		return
+	}
+
+	code := random()
+	var gs []string
+	for _, g := range strings.Split(r.FormValue("groups"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			gs = append(gs, g)
+		}
+	}
+	mu.Lock()
+	codes[code] = grant{
+		redirect:  redirect.String(),
+		challenge: r.FormValue("code_challenge"),
+		nonce:     r.FormValue("nonce"),
+		username:  r.FormValue("username"),
+		groups:    gs,
+		expires:   time.Now().Add(time.Minute),
+	}
+	mu.Unlock()
+
+	q := redirect.Query()
+	q.Set("code", code)
+	q.Set("state", r.FormValue("state"))
+	redirect.RawQuery = q.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func token(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	mu.Lock()
+	g, ok := codes[r.FormValue("code")]
+	delete(codes, r.FormValue("code"))
+	mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	switch {
+	case !ok || time.Now().After(g.expires):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	case g.redirect != r.FormValue("redirect_uri"):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "redirect_uri mismatch"})
+		return
+	case base64.RawURLEncoding.EncodeToString(verifier[:]) != g.challenge:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+
+	now := time.Now()
+	idToken, err := sign(map[string]interface{}{
+		"iss":                *issuer,
+		"sub":                "mock-" + g.username,
+		"aud":                *clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.username,
+		"email":              g.username + "@example.com",
+		"groups":             g.groups,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": random(),
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock",
+			"use": "sig",
+			"alg": "RS256",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}},
+	})
+}
+
+func sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "mock", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func random() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
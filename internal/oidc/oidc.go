@@ -0,0 +1,412 @@
+// Package oidc implements the OpenID Connect authorization code flow with
+// PKCE, using discovery to find the provider's endpoints and keys.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("oidc: invalid id token")
+	ErrUnknownKey   = errors.New("oidc: unknown signing key")
+
+	// Allowed difference between our clock and the provider's.
+	clockSkew = 2 * time.Minute
+)
+
+// Config describes a client registered with the provider.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+// Provider is the discovery document of an issuer.
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the claims of a verified ID token.
+type Claims struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool // the provider checked the address belongs to the subject
+	Name              string
+	PreferredUsername string
+	Raw               map[string]interface{}
+}
+
+// Strings returns a claim that is a string or a list of strings (such as groups).
+func (c Claims) Strings(name string) []string {
+	switch v := c.Raw[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// String returns a string claim.
+func (c Claims) String(name string) string {
+	s, _ := c.Raw[name].(string)
+	return s
+}
+
+type Client struct {
+	config   Config
+	provider Provider
+	http     *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+}
+
+// NewClient discovers the issuer's endpoints.
+func NewClient(ctx context.Context, config Config) (*Client, error) {
+	c := &Client{
+		config: config,
+		http:   &http.Client{Timeout: 30 * time.Second},
+		keys:   make(map[string]crypto.PublicKey),
+	}
+	if len(c.config.Scopes) == 0 {
+		c.config.Scopes = []string{"openid", "profile", "email"}
+	}
+
+	wellknown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := c.getJSON(ctx, wellknown, &c.provider); err != nil {
+		return nil, fmt.Errorf("oidc: discovery failed: %s", err)
+	}
+	if c.provider.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc: issuer %q doesn't match discovered issuer %q", config.Issuer, c.provider.Issuer)
+	}
+	if c.provider.AuthorizationEndpoint == "" || c.provider.TokenEndpoint == "" || c.provider.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: incomplete discovery document from %q", wellknown)
+	}
+	return c, nil
+}
+
+// NewVerifier returns a random PKCE code verifier (also fine for state and nonce).
+func NewVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// AuthCodeURL is where the user is sent to log in.
+func (c *Client) AuthCodeURL(state, nonce, verifier string) string {
+	challenge := sha256.Sum256([]byte(verifier))
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.config.ClientID},
+		"redirect_uri":          {c.config.RedirectURL},
+		"scope":                 {strings.Join(c.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(c.provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return c.provider.AuthorizationEndpoint + sep + v.Encode()
+}
+
+// Exchange trades the authorization code for tokens and verifies the ID token.
+func (c *Client) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.config.RedirectURL},
+		"client_id":     {c.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", c.provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.config.ClientID), url.QueryEscape(c.config.ClientSecret))
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: token request failed: %s: %s", res.Status, string(body))
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, fmt.Errorf("oidc: invalid token response: %s", err)
+	}
+	if token.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token response has no id_token")
+	}
+	return c.Verify(ctx, token.IDToken, nonce)
+}
+
+// Verify checks the ID token's signature and claims.
+func (c *Client) Verify(ctx context.Context, raw, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := c.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := Claims{Raw: make(map[string]interface{})}
+	if err := decodeSegment(parts[1], &claims.Raw); err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims.Issuer = claims.String("iss")
+	claims.Subject = claims.String("sub")
+	claims.Email = claims.String("email")
+	// Some providers send "true" as a string.
+	claims.EmailVerified = claims.Raw["email_verified"] == true || claims.String("email_verified") == "true"
+	claims.Name = claims.String("name")
+	claims.PreferredUsername = claims.String("preferred_username")
+
+	if claims.Issuer != c.provider.Issuer {
+		return nil, fmt.Errorf("oidc: id token issued by %q, not %q", claims.Issuer, c.provider.Issuer)
+	}
+	if !contains(claims.Strings("aud"), c.config.ClientID) {
+		return nil, fmt.Errorf("oidc: id token not issued for client %q", c.config.ClientID)
+	}
+	now := time.Now()
+	exp, ok := claims.Raw["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("oidc: id token expired")
+	}
+	if nbf, ok := claims.Raw["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("oidc: id token not valid yet")
+	}
+	if claims.String("nonce") != nonce {
+		return nil, fmt.Errorf("oidc: id token nonce mismatch")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("oidc: id token has no subject")
+	}
+	return &claims, nil
+}
+
+// key returns the signing key, fetching the key set again if it's unknown (keys rotate).
+func (c *Client) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	keys, err := c.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+
+	// Tokens without a kid are fine if the provider only has one key.
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	if key, ok := keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *Client) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := c.getJSON(ctx, c.provider.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("oidc: fetching keys failed: %s", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("oidc: unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("oidc: unsupported key type %q", k.Kty)
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return ErrInvalidToken
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidToken
+		}
+		return nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+	return fmt.Errorf("oidc: unsupported signing algorithm %q", alg)
+}
+
+func (c *Client) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
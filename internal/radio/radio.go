@@ -0,0 +1,402 @@
+package radio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// MetaInt is the number of audio bytes between ICY metadata blocks.
+	MetaInt = 16000
+
+	// Bitrate of the broadcast stream.
+	Bitrate = "128k"
+
+	// Number of chunks buffered per listener before it's considered too slow.
+	listenerBuffer = 256
+)
+
+// Track is one item played by a station.
+type Track struct {
+	Title    string
+	Filename string
+}
+
+// Playlist returns the tracks for a station, and whether they should be shuffled.
+// It is called at the start of every pass so playlist edits are picked up.
+type Playlist func() (tracks []Track, shuffle bool, err error)
+
+// Format is a broadcast stream encoding.
+type Format struct {
+	Name        string
+	ContentType string
+	codec       []string
+}
+
+var (
+	MP3 = Format{Name: "mp3", ContentType: "audio/mpeg", codec: []string{"-c:a", "libmp3lame", "-f", "mp3"}}
+	AAC = Format{Name: "aac", ContentType: "audio/aac", codec: []string{"-c:a", "aac", "-f", "adts"}}
+)
+
+func FindFormat(name string) (Format, bool) {
+	switch name {
+	case "", MP3.Name:
+		return MP3, true
+	case AAC.Name:
+		return AAC, true
+	}
+	return Format{}, false
+}
+
+// Radio keeps track of all running stations.
+type Radio struct {
+	mu       sync.Mutex
+	stations map[string]*Station
+	logger   *zap.SugaredLogger
+}
+
+func NewRadio(logger *zap.SugaredLogger) *Radio {
+	return &Radio{
+		stations: make(map[string]*Station),
+		logger:   logger,
+	}
+}
+
+// Station returns the station for id in the given format, creating it if necessary.
+func (r *Radio) Station(id string, format Format, playlist Playlist) *Station {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := id + "." + format.Name
+	s, ok := r.stations[key]
+	if !ok {
+		s = &Station{
+			id:        id,
+			format:    format,
+			playlist:  playlist,
+			listeners: make(map[*Listener]struct{}),
+			logger:    r.logger,
+		}
+		r.stations[key] = s
+	}
+	return s
+}
+
+// StopStation stops the station for id in every format, disconnecting its
+// listeners. Listening again starts a new station.
+func (r *Radio) StopStation(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, s := range r.stations {
+		if s.id == id {
+			s.stop()
+			delete(r.stations, key)
+		}
+	}
+}
+
+// Stop stops every running station, disconnecting all listeners.
+func (r *Radio) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range r.stations {
+		s.stop()
+	}
+}
+
+// Station plays a playlist on a loop to any number of listeners in sync.
+// It only runs while somebody is listening, and resumes with the next track.
+type Station struct {
+	mu        sync.RWMutex
+	id        string
+	format    Format
+	playlist  Playlist
+	listeners map[*Listener]struct{}
+	title     string
+	position  int
+	cancel    context.CancelFunc
+	logger    *zap.SugaredLogger
+}
+
+// Title returns the title of the track being played.
+func (s *Station) Title() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.title
+}
+
+// Listeners returns the number of connected listeners.
+func (s *Station) Listeners() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.listeners)
+}
+
+// Listen registers a new listener, starting the station if it's off the air.
+func (s *Station) Listen() *Listener {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l := &Listener{
+		station: s,
+		chunks:  make(chan []byte, listenerBuffer),
+		done:    make(chan struct{}),
+	}
+	s.listeners[l] = struct{}{}
+
+	if s.cancel == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+		go s.playout(ctx)
+	}
+	return l
+}
+
+func (s *Station) leave(l *Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.listeners[l]; !ok {
+		return
+	}
+	delete(s.listeners, l)
+	close(l.done)
+
+	// Nobody is listening, so go off the air.
+	if len(s.listeners) == 0 && s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+func (s *Station) stop() {
+	s.mu.Lock()
+	var listeners []*Listener
+	for l := range s.listeners {
+		listeners = append(listeners, l)
+	}
+	s.mu.Unlock()
+
+	for _, l := range listeners {
+		s.leave(l)
+	}
+}
+
+func (s *Station) broadcast(chunk []byte) {
+	s.mu.RLock()
+	var slow []*Listener
+	for l := range s.listeners {
+		select {
+		case l.chunks <- chunk:
+		default:
+			slow = append(slow, l)
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, l := range slow {
+		s.logger.Debugf("radio %q dropping slow listener", s.id)
+		s.leave(l)
+	}
+}
+
+func (s *Station) playout(ctx context.Context) {
+	s.logger.Infof("radio %q on the air", s.id)
+	defer s.logger.Infof("radio %q off the air", s.id)
+
+	// Disconnect everyone if we stop on our own (e.g. the playlist is gone).
+	defer func() {
+		if ctx.Err() == nil {
+			s.stop()
+		}
+	}()
+
+	for {
+		tracks, shuffle, err := s.playlist()
+		if err != nil {
+			s.logger.Errorf("radio %q playlist failed: %s", s.id, err)
+			return
+		}
+		if len(tracks) == 0 {
+			s.logger.Warnf("radio %q has nothing to play", s.id)
+			return
+		}
+
+		s.mu.Lock()
+		if s.position >= len(tracks) {
+			s.position = 0
+		}
+		start := s.position
+		s.mu.Unlock()
+
+		if shuffle && start == 0 {
+			r := rand.New(rand.NewSource(time.Now().UnixNano()))
+			var shuffled []Track
+			for _, i := range r.Perm(len(tracks)) {
+				shuffled = append(shuffled, tracks[i])
+			}
+			tracks = shuffled
+		}
+
+		for n := start; n < len(tracks); n++ {
+			s.mu.Lock()
+			s.title = tracks[n].Title
+			s.position = n + 1
+			s.mu.Unlock()
+
+			if err := s.play(ctx, tracks[n]); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				s.logger.Errorf("radio %q playing %q failed: %s", s.id, tracks[n].Filename, err)
+			}
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		s.mu.Lock()
+		s.position = 0
+		s.mu.Unlock()
+	}
+}
+
+// play encodes a track in real time and broadcasts it.
+func (s *Station) play(ctx context.Context, track Track) error {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"-re", "-i", track.Filename,
+		"-vn",
+		"-ar", "44100", "-ac", "2",
+		"-b:a", Bitrate,
+	}
+	args = append(args, s.format.codec...)
+	args = append(args, "pipe:1")
+	s.logger.Debugf("radio %q playing with %s %s", s.id, ffmpeg, strings.Join(args, " "))
+
+	cmd := exec.CommandContext(ctx, ffmpeg, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	for {
+		buf := make([]byte, 4096)
+		n, err := stdout.Read(buf)
+		if n > 0 {
+			s.broadcast(buf[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cmd.Wait()
+			return err
+		}
+	}
+	return cmd.Wait()
+}
+
+// Listener receives the station's stream.
+type Listener struct {
+	station *Station
+	chunks  chan []byte
+	done    chan struct{}
+}
+
+// Stream copies the broadcast to w until the listener disconnects or the
+// station goes off the air. If icy is true, ICY metadata is interleaved
+// every MetaInt bytes.
+func (l *Listener) Stream(ctx context.Context, w io.Writer, icy bool) error {
+	defer l.station.leave(l)
+
+	var iw io.Writer = w
+	if icy {
+		iw = &icyWriter{w: w, station: l.station}
+	}
+	flusher, _ := w.(interface{ Flush() })
+
+	for {
+		select {
+		case chunk := <-l.chunks:
+			if _, err := iw.Write(chunk); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-l.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// icyWriter interleaves SHOUTcast/Icecast metadata blocks with the audio.
+type icyWriter struct {
+	w       io.Writer
+	station *Station
+	count   int
+	last    string
+}
+
+func (iw *icyWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := MetaInt - iw.count
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := iw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		iw.count += n
+		p = p[n:]
+
+		if iw.count == MetaInt {
+			if _, err := iw.w.Write(iw.metadata()); err != nil {
+				return written, err
+			}
+			iw.count = 0
+		}
+	}
+	return written, nil
+}
+
+func (iw *icyWriter) metadata() []byte {
+	title := iw.station.Title()
+
+	// Unchanged metadata is sent as an empty block.
+	if title == iw.last {
+		return []byte{0}
+	}
+	iw.last = title
+
+	meta := fmt.Sprintf("StreamTitle='%s';", strings.Replace(title, "'", "", -1))
+	blocks := (len(meta) + 15) / 16
+	if blocks > 255 {
+		blocks = 255
+		meta = meta[:blocks*16]
+	}
+	buf := make([]byte, 1+blocks*16)
+	buf[0] = byte(blocks)
+	copy(buf[1:], meta)
+	return buf
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// The persisted logs are in this folder of the data directory.
+	logsDir     = "logs"
+	logFilename = "soundscape.log"
+
+	// Comments are sent this often on event streams (the logs, the archiver's
+	// events), so proxies don't close the connection when nothing happens.
+	streamKeepalive = 30 * time.Second
+)
+
+// LogLevels are the levels the logs can be filtered by.
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+// LogFilter selects log lines at or above a level that contain a substring.
+type LogFilter struct {
+	Level zapcore.Level
+	Query string
+}
+
+func NewLogFilter(r *http.Request) LogFilter {
+	f := LogFilter{Level: zapcore.DebugLevel, Query: strings.TrimSpace(r.FormValue("q"))}
+	if level := r.FormValue("level"); level != "" {
+		f.Level.UnmarshalText([]byte(level))
+	}
+	return f
+}
+
+func (f LogFilter) Match(line string) bool {
+	if strings.TrimSpace(line) == "" {
+		return false
+	}
+	// Lines without a level (e.g. a panic's stack trace) are never filtered out by level.
+	if level, ok := lineLevel(line); ok && level < f.Level {
+		return false
+	}
+	return f.Query == "" || strings.Contains(strings.ToLower(line), strings.ToLower(f.Query))
+}
+
+// lineLevel finds the level of a log line, e.g. "1.5038698658e+09	info	message"
+// or {"level":"info","ts":1.5038698658e+09,"msg":"message"} with --log-format json.
+func lineLevel(line string) (zapcore.Level, bool) {
+	var text string
+	if strings.HasPrefix(line, "{") {
+		var entry struct {
+			Level string `json:"level"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return 0, false
+		}
+		text = entry.Level
+	} else {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) < 3 {
+			return 0, false
+		}
+		text = fields[1]
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(text)); err != nil {
+		return 0, false
+	}
+	return level, true
+}
+
+// LogFile is a persisted log file.
+type LogFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+func savedLogFiles() []LogFile {
+	var files []LogFile
+	for _, filename := range logtail.Files() {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			continue
+		}
+		files = append(files, LogFile{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return files
+}
+
+// PersistLogs saves the log in the data directory, rotating it when it
+// reaches maxSize and keeping keep old files.
+func PersistLogs(maxSize int64, keep int) error {
+	dir := filepath.Join(datadir, logsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return logtail.Persist(filepath.Join(dir, logFilename), maxSize, keep)
+}
+
+//
+// Handlers
+//
+
+func logs(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	filter := NewLogFilter(r)
+	var lines []string
+	for _, line := range logtail.Lines() {
+		if filter.Match(line) {
+			lines = append(lines, line)
+		}
+	}
+
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			fmt.Fprintf(w, "%s\n", line)
+		}
+		return
+	}
+
+	res := NewResponse(r, ps)
+	res.LogLines = lines
+	res.LogLevels = LogLevels
+	res.LogFiles = savedLogFiles()
+	res.Section = "logs"
+	HTML(w, "logs.html", res)
+}
+
+// logsStream follows the log with server-sent events, one line per event.
+func logsStream(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		Error(w, fmt.Errorf("streaming isn't supported"))
+		return
+	}
+	filter := NewLogFilter(r)
+
+	sub := logtail.Subscribe()
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // nginx
+	fmt.Fprintf(w, "retry: 5000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case line := <-sub.Lines():
+			if !filter.Match(line) {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", line); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-sub.Done():
+			// Dropped for falling behind or shutting down; the browser reconnects.
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func logFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	for _, filename := range logtail.Files() {
+		if filepath.Base(filename) != name {
+			continue
+		}
+		f, err := os.Open(filename)
+		if err != nil {
+			Error(w, err)
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			Error(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		http.ServeContent(w, r, name, fi.ModTime(), f)
+		return
+	}
+	http.NotFound(w, r)
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
@@ -14,12 +16,18 @@ import (
 	"time"
 
 	"github.com/soundscapecloud/soundscape/internal/archiver"
+	"github.com/soundscapecloud/soundscape/internal/hls"
 	"github.com/soundscapecloud/soundscape/internal/logtailer"
+	"github.com/soundscapecloud/soundscape/internal/metrics"
+	"github.com/soundscapecloud/soundscape/internal/oidc"
+	"github.com/soundscapecloud/soundscape/internal/radio"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
+	humanize "github.com/dustin/go-humanize"
 	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
@@ -36,22 +44,82 @@ var (
 	httpPrefix             string
 	httpUsername           string
 	letsencrypt            bool
+	httpRedirectAddr       string
 	reverseProxyAuthHeader string
 	reverseProxyAuthIP     string
+	trustedProxies         string
+
+	// TLS
+	tlsCert       string
+	tlsKey        string
+	acmeDirectory string
+	acmeEmail     string
+	acmeCACert    string
+
+	// OpenID Connect
+	oidcIssuer        string
+	oidcClientID      string
+	oidcClientSecret  string
+	oidcRedirectURL   string
+	oidcUsernameClaim string
+	oidcGroupsClaim   string
+	oidcAdminGroup    string
+	oidcUserGroup     string
+
+	// how long deleted media and playlists are kept
+	trashRetention time.Duration
+
+	// how long to wait for requests and archiver jobs when shutting down
+	shutdownTimeout time.Duration
+
+	// /readyz fails with less free disk space than this
+	minFreeSpaceFlag string
+	minFreeSpace     uint64
+
+	// simultaneous archiver jobs, their download rate (0: unlimited) and when they may start
+	archiverConcurrency   int
+	archiverBandwidthFlag string
+	archiverScheduleFlag  string
+	archiverBandwidth     uint64
+	archiverSchedule      archiver.Schedule
+
+	// rotated log files kept in the data directory (0: the log isn't saved)
+	logFiles        int
+	logFileSizeFlag string
 
 	// set based on httpAddr
 	httpIP   string
 	httpPort string
 
+	// when this process started
+	startTime = time.Now()
+
 	// logging
-	logger  *zap.SugaredLogger
-	logtail *logtailer.Logtailer
+	logFormat string
+	logLevel  = zap.NewAtomicLevel()
+	logger    *zap.SugaredLogger
+	accessLog *zap.SugaredLogger
+	logtail   *logtailer.Logtailer
 
 	// archiver
 	archive *archiver.Archiver
 
-	// secrets
-	authsecret *Secret
+	// hls
+	segmenter *hls.Segmenter
+
+	// radio
+	stations *radio.Radio
+
+	// sso
+	sso *oidc.Client
+
+	// users
+	users    *Users
+	sessions *Sessions
+	tokens   *Tokens
+	shares   *Shares
+	audit    *AuditLog
+	throttle = NewThrottle(5, 15*time.Minute)
 
 	// config
 	config *Config
@@ -61,6 +129,7 @@ var (
 )
 
 func init() {
+	cli.StringVar(&configFile, "config", "", "JSON file with flag values, e.g. {\"http-host\": \"music.example.com\"} (optional)")
 	cli.StringVar(&backlink, "backlink", "", "backlink (optional)")
 	cli.StringVar(&datadir, "data-dir", "/data", "data directory")
 	cli.BoolVar(&debug, "debug", false, "debug mode")
@@ -68,10 +137,34 @@ func init() {
 	cli.StringVar(&httpAddr, "http-addr", ":80", "listen address")
 	cli.StringVar(&httpHost, "http-host", "", "HTTP host")
 	cli.StringVar(&httpUsername, "http-username", "soundscape", "HTTP basic auth username")
-	cli.StringVar(&httpPrefix, "http-prefix", "/soundscape", "HTTP URL prefix (not actually supported yet!)")
-	cli.BoolVar(&letsencrypt, "letsencrypt", false, "enable TLS using Let's Encrypt")
+	cli.StringVar(&httpPrefix, "http-prefix", "/soundscape", "HTTP URL prefix, e.g. /music (/ for the root)")
+	cli.BoolVar(&letsencrypt, "letsencrypt", false, "enable TLS using Let's Encrypt (or the --acme-directory)")
+	cli.StringVar(&httpRedirectAddr, "http-redirect-addr", "", "listen address redirecting HTTP to HTTPS and answering ACME HTTP-01 challenges (default: port 80 with --letsencrypt)")
+	cli.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file, reloaded when it changes (instead of --letsencrypt)")
+	cli.StringVar(&tlsKey, "tls-key", "", "TLS private key file")
+	cli.StringVar(&acmeDirectory, "acme-directory", autocert.DefaultACMEDirectory, "ACME directory URL used with --letsencrypt")
+	cli.StringVar(&acmeEmail, "acme-email", "", "contact email for the ACME account (optional)")
+	cli.StringVar(&acmeCACert, "acme-ca-cert", "", "CA certificate to trust for the ACME directory, e.g. a local test CA (optional)")
 	cli.StringVar(&reverseProxyAuthHeader, "reverse-proxy-header", "X-Authenticated-User", "reverse proxy auth header")
 	cli.StringVar(&reverseProxyAuthIP, "reverse-proxy-ip", "", "reverse proxy auth IP")
+	cli.StringVar(&trustedProxies, "trusted-proxies", "", "comma separated IPs of reverse proxies whose X-Forwarded-For gives the client's address (optional)")
+	cli.StringVar(&oidcIssuer, "oidc-issuer", "", "OpenID Connect issuer URL (enables SSO login)")
+	cli.StringVar(&oidcClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	cli.StringVar(&oidcClientSecret, "oidc-client-secret", "", "OpenID Connect client secret (optional with PKCE)")
+	cli.StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL (default: based on --http-host)")
+	cli.StringVar(&oidcUsernameClaim, "oidc-username-claim", "preferred_username", "OpenID Connect claim used as the username")
+	cli.StringVar(&oidcGroupsClaim, "oidc-groups-claim", "groups", "OpenID Connect claim with the user's groups")
+	cli.StringVar(&oidcAdminGroup, "oidc-admin-group", "", "OpenID Connect group of admins (optional)")
+	cli.StringVar(&oidcUserGroup, "oidc-user-group", "", "OpenID Connect group allowed to log in (optional, default: everybody)")
+	cli.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for requests and downloads to finish when stopping")
+	cli.StringVar(&minFreeSpaceFlag, "min-free-space", "1GB", "free disk space in the data directory below which /readyz fails")
+	cli.StringVar(&logFormat, "log-format", "console", "log format: console or json")
+	cli.IntVar(&logFiles, "log-files", 0, "number of rotated log files to keep in the data directory's logs folder (0: the log isn't saved)")
+	cli.StringVar(&logFileSizeFlag, "log-file-size", "10MB", "size at which the saved log file is rotated")
+	cli.IntVar(&archiverConcurrency, "archiver-concurrency", 2, "number of imports downloaded and transcoded at the same time")
+	cli.StringVar(&archiverBandwidthFlag, "archiver-bandwidth", "0", "download rate of all imports together per second, e.g. 2MB (0: unlimited)")
+	cli.StringVar(&archiverScheduleFlag, "archiver-schedule", "", "times of day imports may start, e.g. 22:00-06:00 (default: any time)")
+	cli.DurationVar(&trashRetention, "trash-retention", 30*24*time.Hour, "how long deleted media and playlists are kept in the trash (0 deletes right away)")
 }
 
 func main() {
@@ -84,6 +177,13 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Flags not given on the command line come from the environment, then the --config file.
+	if err := LoadSettings(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n\n", err)
+		cli.PrintDefaults()
+		os.Exit(1)
+	}
+
 	// logtailer
 	logtail, err = logtailer.NewLogtailer(200 * 1024)
 	if err != nil {
@@ -91,22 +191,27 @@ func main() {
 	}
 
 	// logger
-	atomlevel := zap.NewAtomicLevel()
+	var encoder zapcore.Encoder
+	switch logFormat {
+	case "console":
+		encoder = zapcore.NewConsoleEncoder(zap.NewProductionEncoderConfig())
+	case "json":
+		encoder = zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: the --log-format must be console or json\n\n")
+		cli.PrintDefaults()
+		os.Exit(1)
+	}
 	l := zap.New(
 		zapcore.NewCore(
-			zapcore.NewConsoleEncoder(zap.NewProductionEncoderConfig()),
+			encoder,
 			zapcore.NewMultiWriteSyncer(zapcore.Lock(zapcore.AddSync(os.Stdout)), logtail),
-			atomlevel,
+			logLevel,
 		),
 	)
 	defer l.Sync()
 	logger = l.Sugar()
-
-	// debug logging
-	if debug {
-		atomlevel.SetLevel(zap.DebugLevel)
-	}
-	logger.Debugf("debug logging is enabled")
+	accessLog = logger.Named("access")
 
 	// config
 	config, err = NewConfig("config.json")
@@ -114,8 +219,29 @@ func main() {
 		logger.Fatal(err)
 	}
 
-	// archiver
-	archive = archiver.NewArchiver(datadir, 2, logger)
+	// usage
+	usage := func(msg string) {
+		fmt.Fprintf(os.Stderr, "ERROR: "+msg+"\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: %s --http-host music.example.com\n\n", os.Args[0])
+		cli.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// settings changed on the settings page, and the debug level
+	if err := ApplySavedSettings(); err != nil {
+		usage(err.Error())
+	}
+	logger.Debugf("debug logging is enabled")
+
+	// metrics
+	metrics.RegisterRuntime(registry)
+	registry.OnCollect(collectMetrics)
+
+	// hls
+	segmenter = hls.NewSegmenter(logger)
+
+	// radio
+	stations = radio.NewRadio(logger)
 
 	// datadir
 	datadir = filepath.Clean(datadir)
@@ -131,15 +257,50 @@ func main() {
 			logger.Fatal(err)
 		}
 		if len(lists) == 0 {
-			_, err := NewList("My Music")
+			_, err := NewList("My Music", "")
 			if err != nil {
 				logger.Fatal(err)
 			}
 		}
 	}
 
+	// persisted logs
+	if logFiles > 0 {
+		size, err := humanize.ParseBytes(logFileSizeFlag)
+		if err != nil {
+			logger.Fatalf("invalid --log-file-size: %s", err)
+		}
+		if err := PersistLogs(int64(size), logFiles); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	// users
+	users, err = NewUsers("users.json")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	sessions, err = NewSessions("sessions.json", ".sessionkey")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	tokens, err = NewTokens("tokens.json")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	shares, err = NewShares("shares.json")
+	if err != nil {
+		logger.Fatal(err)
+	}
+	audit, err = NewAuditLog("audit.log")
+	if err != nil {
+		logger.Fatal(err)
+	}
+
 	// remove any temporary transcode files
 	tmpfiles, _ := filepath.Glob(datadir + "/*.transcoding")
+	normalizing, _ := filepath.Glob(datadir + "/*.normalizing")
+	tmpfiles = append(tmpfiles, normalizing...)
 	for _, tmpfile := range tmpfiles {
 		logger.Debugf("removing %q", tmpfile)
 		if err := os.Remove(tmpfile); err != nil {
@@ -147,19 +308,39 @@ func main() {
 		}
 	}
 
-	// usage
-	usage := func(msg string) {
-		fmt.Fprintf(os.Stderr, "ERROR: "+msg+"\n\n")
-		fmt.Fprintf(os.Stderr, "Usage: %s --http-host music.example.com\n\n", os.Args[0])
-		cli.PrintDefaults()
-		os.Exit(1)
+	// remove any interrupted hls segmenting
+	tmpfiles, _ = filepath.Glob(datadir + "/*.hls/*.segmenting")
+	for _, tmpfile := range tmpfiles {
+		logger.Debugf("removing %q", tmpfile)
+		if err := os.Remove(tmpfile); err != nil {
+			logger.Errorf("removing %q failed: %s", tmpfile, err)
+		}
+	}
+
+	// archiver, once the data directory is cleaned up and the stores its
+	// callbacks use are open
+	archive = archiver.NewArchiver(datadir, archiverConcurrency, logger)
+	archive.SetBandwidth(int64(archiverBandwidth))
+	archive.SetSchedule(archiverSchedule)
+	archive.SetNormalize(config.Get().Normalize)
+	archive.OnComplete(Archived)
+	archive.OnCancel(removeUnarchived)
+	archive.OnPhase(archiverPhase)
+	if err := ResumePendingJobs(); err != nil {
+		logger.Errorf("resuming archiver jobs failed: %s", err)
 	}
 
+	// purge expired trash
+	go Purger()
+
 	// http host
 	if httpHost == "" {
 		usage("the --http-host flag is required")
 	}
 	httpPrefix = strings.TrimRight(httpPrefix, "/")
+	if httpPrefix != "" && !strings.HasPrefix(httpPrefix, "/") {
+		usage("the --http-prefix must start with a slash, e.g. /music")
+	}
 
 	// http port
 	httpIP, httpPort, err := net.SplitHostPort(httpAddr)
@@ -167,9 +348,74 @@ func main() {
 		usage("invalid --http-addr: " + err.Error())
 	}
 
-	// auth secret is the password for basic auth
+	// tls
+	if (tlsCert == "") != (tlsKey == "") {
+		usage("the --tls-cert and --tls-key flags must be used together")
+	}
+	if tlsCert != "" && letsencrypt {
+		usage("--tls-cert can't be used with --letsencrypt")
+	}
+	if letsencrypt && httpRedirectAddr == "" {
+		httpRedirectAddr = net.JoinHostPort(httpIP, "80")
+	}
+
+	// The first admin logs in with the password from .authsecret, or a generated one.
 	if reverseProxyAuthIP == "" {
-		authsecret = NewSecret(filepath.Join(datadir, ".authsecret"))
+		secretfile := filepath.Join(datadir, ".authsecret")
+		if users.Len() == 0 {
+			password := ""
+			if b, err := ioutil.ReadFile(secretfile); err == nil {
+				password = strings.TrimSpace(string(b))
+			}
+			generated := password == ""
+			if generated {
+				password, err = RandomString(12)
+				if err != nil {
+					logger.Fatal(err)
+				}
+			}
+			if _, err := users.Add(httpUsername, password, true); err != nil {
+				logger.Fatalf("creating user %q failed: %s", httpUsername, err)
+			}
+			if generated {
+				logger.Infof("Login credentials:  %s  /  %s", httpUsername, password)
+			}
+		}
+
+		// The password is hashed in the users store now, so don't leave it lying around.
+		if err := os.Remove(secretfile); err == nil {
+			logger.Infof("removed %s", secretfile)
+		}
+	}
+
+	// OpenID Connect login
+	if oidcIssuer != "" {
+		if reverseProxyAuthIP != "" {
+			usage("--oidc-issuer can't be used with --reverse-proxy-ip")
+		}
+		if oidcRedirectURL == "" {
+			u := &url.URL{Scheme: "http", Host: net.JoinHostPort(httpHost, httpPort), Path: URL("/login/oidc/callback")}
+			if letsencrypt || tlsCert != "" {
+				u.Scheme = "https"
+			}
+			// TLS moves port 80 to 443.
+			if httpPort == "80" || httpPort == "443" {
+				u.Host = httpHost
+			}
+			oidcRedirectURL = u.String()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		sso, err = oidc.NewClient(ctx, oidc.Config{
+			Issuer:       oidcIssuer,
+			ClientID:     oidcClientID,
+			ClientSecret: oidcClientSecret,
+			RedirectURL:  oidcRedirectURL,
+		})
+		cancel()
+		if err != nil {
+			logger.Fatal(err)
+		}
+		logger.Infof("OpenID Connect login with %s (redirect URL %s)", oidcIssuer, oidcRedirectURL)
 	}
 
 	//
@@ -181,77 +427,154 @@ func main() {
 	r.HandleMethodNotAllowed = false
 
 	// Handlers
-	r.GET("/", Log(Auth(index, false)))
-	r.GET(Prefix("/logs"), Log(Auth(logs, false)))
+	// Mounted under a prefix, "/" sends browsers to it.
+	if httpPrefix != "" {
+		r.GET("/", Log(Auth(index, false)))
+		r.GET(Prefix(""), Log(Auth(home, false)))
+
+		// Probes that don't go through the reverse proxy don't know the prefix.
+		r.GET("/healthz", healthz)
+		r.GET("/readyz", readyz)
+	}
+	r.GET(Prefix("/healthz"), healthz)
+	r.GET(Prefix("/readyz"), readyz)
+	r.GET(Prefix("/logs"), Log(Auth(Admin(logs), false)))
+	r.GET(Prefix("/logs/stream"), Log(Auth(Admin(logsStream), false)))
+	r.GET(Prefix("/logs/files/:name"), Log(Auth(Admin(logFile), false)))
+	r.GET(Prefix("/login"), Log(login))
+	r.POST(Prefix("/login"), Log(login))
+	r.POST(Prefix("/logout"), Log(logout))
+	r.GET(Prefix("/login/oidc"), Log(oidcLogin))
+	r.GET(Prefix("/login/oidc/callback"), Log(oidcCallback))
+	r.GET(Prefix("/account"), Log(Auth(account, false)))
+	r.POST(Prefix("/account/password"), Log(Auth(changePassword, false)))
+	r.POST(Prefix("/account/sso"), Log(Auth(linkSSO, false)))
+	r.GET(Prefix("/tokens"), Log(Auth(tokensHandler, false)))
+	r.POST(Prefix("/tokens/create"), Log(Auth(createToken, false)))
+	r.POST(Prefix("/tokens/revoke/:id"), Log(Auth(revokeToken, false)))
 	r.GET(Prefix("/"), Log(Auth(home, false)))
-	r.GET(Prefix(""), Log(Auth(home, false)))
 
 	// Library
 	r.GET(Prefix("/library"), Log(Auth(library, false)))
 
 	// Help
 	r.GET(Prefix("/help"), Log(Auth(help, false)))
+	r.POST(Prefix("/tos"), Log(Auth(acceptTOS, false)))
 
 	// Media
 	r.GET(Prefix("/media/thumbnail/:media"), Log(Auth(thumbnailMedia, false)))
 	r.GET(Prefix("/media/view/:media"), Log(Auth(viewMedia, false)))
-	r.GET(Prefix("/media/delete/:media"), Log(Auth(deleteMedia, false)))
+	r.POST(Prefix("/media/delete/:media"), Log(Scope(ScopeImport, Auth(deleteMedia, false))))
+	r.POST(Prefix("/media/trim/:media"), Log(Scope(ScopeImport, Auth(trimMedia, false))))
+	r.POST(Prefix("/media/split/:media"), Log(Scope(ScopeImport, Auth(splitMedia, false))))
+	r.POST(Prefix("/media/private/:media"), Log(Scope(ScopeImport, Auth(privateMedia, false))))
 	r.GET(Prefix("/media/access/:filename"), Auth(streamMedia, false))
 	r.GET(Prefix("/media/download/:media"), Auth(downloadMedia, false))
 
-	// Publicly accessible streaming (using playlist id as "auth")
-	r.GET(Prefix("/stream/:list/:filename"), Auth(streamMedia, true))
+	// Publicly accessible streaming (using a share id, or a playlist id when logged in)
+	r.GET(Prefix("/stream/:list/:filename"), ShareAuth("list", streamMedia))
+	r.GET(Prefix("/stream/:list/:filename/:hls"), ShareAuth("list", streamHLS)) // :filename is the media id
+
+	// Shares
+	r.GET(Prefix("/shares"), Log(Auth(sharesHandler, false)))
+	r.POST(Prefix("/shares/create"), Log(Scope(ScopePlaylist, Auth(createShare, false))))
+	r.POST(Prefix("/shares/revoke/:id"), Log(Scope(ScopePlaylist, Auth(revokeShare, false))))
+	r.POST(Prefix("/share/unlock/:id"), Log(unlockShare))
+	r.GET(Prefix("/share/download/:id/:media"), Log(ShareAuth("id", downloadShare)))
 
 	// Import
 	r.GET(Prefix("/import"), Log(Auth(importHandler, false)))
 
 	// Archiver
 	r.GET(Prefix("/archiver/jobs"), Auth(archiverJobs, false))
-	r.POST(Prefix("/archiver/save/:id"), Log(Auth(archiverSave, false)))
-	r.GET(Prefix("/archiver/cancel/:id"), Log(Auth(archiverCancel, false)))
+	r.POST(Prefix("/archiver/save/:id"), Log(Scope(ScopeImport, Auth(archiverSave, false))))
+	r.POST(Prefix("/archiver/cancel/:id"), Log(Scope(ScopeImport, Auth(archiverCancel, false))))
+	r.POST(Prefix("/archiver/cancel-all"), Log(Scope(ScopeAdmin, Auth(Admin(archiverCancelAll), false))))
+	r.POST(Prefix("/archiver/clear-failed"), Log(Scope(ScopeAdmin, Auth(Admin(archiverClearFailed), false))))
+	r.POST(Prefix("/archiver/move/:id"), Log(Scope(ScopeImport, Auth(archiverMove, false))))
+	r.GET(Prefix("/archiver/events"), Log(Auth(archiverEvents, false)))
 
 	// List
 	r.GET(Prefix("/create"), Log(Auth(createList, false)))
-	r.POST(Prefix("/create"), Log(Auth(createList, false)))
-	r.POST(Prefix("/add/:list/:media"), Log(Auth(addMediaList, false)))
-	r.POST(Prefix("/remove/:list/:media"), Log(Auth(removeMediaList, false)))
-	r.GET(Prefix("/remove/:list/:media"), Log(Auth(removeMediaList, false)))
+	r.POST(Prefix("/create"), Log(Scope(ScopePlaylist, Auth(createList, false))))
+	r.POST(Prefix("/add/:list/:media"), Log(Scope(ScopePlaylist, Auth(addMediaList, false))))
+	r.POST(Prefix("/remove/:list/:media"), Log(Scope(ScopePlaylist, Auth(removeMediaList, false))))
 
 	r.GET(Prefix("/edit/:id"), Log(Auth(editList, false)))
-	r.POST(Prefix("/edit/:id"), Log(Auth(editList, false)))
-	r.GET(Prefix("/shuffle/:id"), Log(Auth(shuffleList, false)))
-	r.GET(Prefix("/play/:id"), Log(Auth(playList, true)))
-	r.GET(Prefix("/m3u/:id"), Log(Auth(m3uList, true)))
-	r.GET(Prefix("/podcast/:id"), Log(Auth(podcastList, true)))
+	r.POST(Prefix("/edit/:id"), Log(Scope(ScopePlaylist, Auth(editList, false))))
+	r.POST(Prefix("/shuffle/:id"), Log(Scope(ScopePlaylist, Auth(shuffleList, false))))
+	r.GET(Prefix("/play/:id"), Log(ShareAuth("id", playList)))
+	r.GET(Prefix("/m3u/:id"), Log(ShareAuth("id", m3uList)))
+	r.GET(Prefix("/podcast/:id"), Log(ShareAuth("id", podcastList)))
+	r.GET(Prefix("/radio/:id"), ShareAuth("id", radioList))
+
+	r.POST(Prefix("/config"), Log(Scope(ScopeImport, Auth(configHandler, false))))
+
+	// Users
+	r.GET(Prefix("/users"), Log(Auth(Admin(usersHandler), false)))
+	r.POST(Prefix("/users/create"), Log(Auth(Admin(createUser), false)))
+	r.POST(Prefix("/users/admin/:username"), Log(Auth(Admin(adminUser), false)))
+	r.POST(Prefix("/users/delete/:username"), Log(Auth(Admin(deleteUser), false)))
+
+	// Trash
+	r.GET(Prefix("/trash"), Log(Auth(trashHandler, false)))
+	r.POST(Prefix("/trash/restore/:id"), Log(Scope(ScopeImport, Auth(restoreTrash, false))))
+	r.POST(Prefix("/trash/purge/:id"), Log(Scope(ScopeImport, Auth(purgeTrash, false))))
+
+	// Settings
+	r.GET(Prefix("/settings"), Log(Auth(Admin(settingsHandler), false)))
+	r.POST(Prefix("/settings"), Log(Auth(Admin(saveSettings), false)))
 
-	r.POST(Prefix("/config"), Log(Auth(configHandler, false)))
+	// Audit log
+	r.GET(Prefix("/audit"), Log(Auth(Admin(auditHandler), false)))
 
-	r.GET(Prefix("/delete/:id"), Log(Auth(deleteList, false)))
+	r.POST(Prefix("/delete/:id"), Log(Scope(ScopePlaylist, Auth(deleteList, false))))
 
 	// API
 	r.GET(Prefix("/v1/status"), Log(Auth(v1status, true)))
+	r.GET(Prefix("/metrics"), Log(Scope(ScopeMetrics, Auth(metricsHandler, false))))
+
+	// JSON API
+	for _, route := range APIRoutes() {
+		r.Handle(route.Method, Prefix(apiPath(route.Path)), APIHandle(route))
+	}
 
 	// Subsonic API
-	r.GET("/rest/ping.view", Log(Auth(subsonicPing, true)))
-	r.POST("/rest/ping.view", Log(Auth(subsonicPing, true)))
+	r.GET(Prefix("/rest/ping.view"), Log(Auth(subsonicPing, true)))
+	r.POST(Prefix("/rest/ping.view"), Log(Auth(subsonicPing, true)))
+
+	r.GET(Prefix("/rest/getMusicFolders.view"), Log(Auth(subsonicGetMusicFolders, true)))
+	r.POST(Prefix("/rest/getMusicFolders.view"), Log(Auth(subsonicGetMusicFolders, true)))
+
+	r.GET(Prefix("/rest/getIndexes.view"), Log(Auth(subsonicGetIndexes, true)))
+	r.POST(Prefix("/rest/getIndexes.view"), Log(Auth(subsonicGetIndexes, true)))
 
-	r.GET("/rest/getMusicFolders.view", Log(Auth(subsonicGetMusicFolders, true)))
-	r.POST("/rest/getMusicFolders.view", Log(Auth(subsonicGetMusicFolders, true)))
+	r.GET(Prefix("/rest/getPlaylists.view"), Log(Auth(subsonicGetPlaylists, true)))
+	r.POST(Prefix("/rest/getPlaylists.view"), Log(Auth(subsonicGetPlaylists, true)))
 
-	r.GET("/rest/getIndexes.view", Log(Auth(subsonicGetIndexes, true)))
-	r.POST("/rest/getIndexes.view", Log(Auth(subsonicGetIndexes, true)))
+	r.GET(Prefix("/rest/getPlaylist.view"), Log(Auth(subsonicGetPlaylist, true)))
+	r.POST(Prefix("/rest/getPlaylist.view"), Log(Auth(subsonicGetPlaylist, true)))
 
-	r.GET("/rest/getPlaylists.view", Log(Auth(subsonicGetPlaylists, true)))
-	r.POST("/rest/getPlaylists.view", Log(Auth(subsonicGetPlaylists, true)))
+	r.GET(Prefix("/rest/getCoverArt.view"), Log(Auth(subsonicGetCoverArt, true)))
+	r.POST(Prefix("/rest/getCoverArt.view"), Log(Auth(subsonicGetCoverArt, true)))
 
-	r.GET("/rest/getPlaylist.view", Log(Auth(subsonicGetPlaylist, true)))
-	r.POST("/rest/getPlaylist.view", Log(Auth(subsonicGetPlaylist, true)))
+	r.GET(Prefix("/rest/getLyrics.view"), Log(Auth(subsonicGetLyrics, true)))
+	r.POST(Prefix("/rest/getLyrics.view"), Log(Auth(subsonicGetLyrics, true)))
 
-	r.GET("/rest/getCoverArt.view", Log(Auth(subsonicGetCoverArt, true)))
-	r.POST("/rest/getCoverArt.view", Log(Auth(subsonicGetCoverArt, true)))
+	r.GET(Prefix("/rest/getInternetRadioStations.view"), Log(Auth(subsonicGetInternetRadioStations, true)))
+	r.POST(Prefix("/rest/getInternetRadioStations.view"), Log(Auth(subsonicGetInternetRadioStations, true)))
 
-	r.GET("/rest/getLyrics.view", Log(Auth(subsonicGetLyrics, true)))
-	r.POST("/rest/getLyrics.view", Log(Auth(subsonicGetLyrics, true)))
+	r.GET(Prefix("/rest/getUser.view"), Log(Auth(subsonicGetUser, true)))
+	r.POST(Prefix("/rest/getUser.view"), Log(Auth(subsonicGetUser, true)))
+
+	r.GET(Prefix("/rest/getUsers.view"), Log(Auth(subsonicGetUsers, true)))
+	r.POST(Prefix("/rest/getUsers.view"), Log(Auth(subsonicGetUsers, true)))
+
+	r.GET(Prefix("/rest/createUser.view"), Log(Scope(ScopeAdmin, Auth(subsonicCreateUser, true))))
+	r.POST(Prefix("/rest/createUser.view"), Log(Scope(ScopeAdmin, Auth(subsonicCreateUser, true))))
+
+	r.GET(Prefix("/rest/deleteUser.view"), Log(Scope(ScopeAdmin, Auth(subsonicDeleteUser, true))))
+	r.POST(Prefix("/rest/deleteUser.view"), Log(Scope(ScopeAdmin, Auth(subsonicDeleteUser, true))))
 
 	// Assets
 	r.GET(Prefix("/static/*path"), Auth(staticAsset, true)) // TODO: Auth() but by checking Origin/Referer for a valid playlist ID?
@@ -264,7 +587,7 @@ func main() {
 	maxHeaderBytes := 10 * (1024 * 1024) // 10 MB
 
 	// Plain text web server.
-	if !letsencrypt {
+	if !letsencrypt && tlsCert == "" {
 		httpd := &http.Server{
 			Handler:        r,
 			Addr:           httpAddr,
@@ -280,50 +603,16 @@ func main() {
 		logger.Infof("Soundscape version: %s %s", version, &url.URL{
 			Scheme: "http",
 			Host:   hostport,
-			Path:   httpPrefix + "/",
+			Path:   URL("/"),
 		})
-
-		if authsecret != nil {
-			logger.Infof("Login credentials:  %s  /  %s", httpUsername, authsecret.Get())
-		}
-		logger.Fatal(httpd.ListenAndServe())
-	}
-
-	// Let's Encrypt TLS mode
-
-	// autocert
-	certmanager := autocert.Manager{
-		Prompt:     autocert.AcceptTOS,
-		Cache:      autocert.DirCache(filepath.Join(datadir, ".autocert")),
-		HostPolicy: autocert.HostWhitelist(httpHost, "www."+httpHost),
+		Serve(httpd.ListenAndServe, httpd)
+		return
 	}
 
-	// http redirect to https and Let's Encrypt auth
-	go func() {
-		redir := httprouter.New()
-		redir.GET("/*path", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-			r.URL.Scheme = "https"
-			r.URL.Host = net.JoinHostPort(httpHost, httpPort)
-			http.Redirect(w, r, r.URL.String(), http.StatusFound)
-		})
-
-		httpd := &http.Server{
-			Handler:        certmanager.HTTPHandler(redir),
-			Addr:           net.JoinHostPort(httpIP, "80"),
-			WriteTimeout:   httpTimeout,
-			ReadTimeout:    httpTimeout,
-			MaxHeaderBytes: maxHeaderBytes,
-		}
-		if err := httpd.ListenAndServe(); err != nil {
-			logger.Fatalf("http server on port 80 failed: %s", err)
-		}
-	}()
-
-	// TLS
+	// TLS mode
 	tlsConfig := tls.Config{
-		GetCertificate: certmanager.GetCertificate,
-		NextProtos:     []string{"http/1.1"},
-		Rand:           rand.Reader,
+		NextProtos:               []string{"h2", "http/1.1"},
+		Rand:                     rand.Reader,
 		PreferServerCipherSuites: true,
 		MinVersion:               tls.VersionTLS12,
 		CipherSuites: []uint16{
@@ -337,6 +626,62 @@ func main() {
 		},
 	}
 
+	// http redirect to https (and ACME HTTP-01 challenges)
+	redir := httprouter.New()
+	redir.GET("/*path", func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		r.URL.Scheme = "https"
+		r.URL.Host = net.JoinHostPort(httpHost, httpPort)
+		if httpPort == "443" || httpPort == "80" {
+			r.URL.Host = httpHost
+		}
+		http.Redirect(w, r, r.URL.String(), http.StatusFound)
+	})
+	var redirHandler http.Handler = redir
+
+	if tlsCert != "" {
+		// Bring your own certificate
+		reloader, err := NewCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			logger.Fatalf("loading TLS certificate failed: %s", err)
+		}
+		go reloader.Watch(tlsReloadInterval)
+		tlsConfig.GetCertificate = reloader.GetCertificate
+	} else {
+		// ACME (Let's Encrypt, or another CA)
+		client, err := acmeHTTPClient(acmeCACert)
+		if err != nil {
+			logger.Fatalf("loading ACME CA certificate failed: %s", err)
+		}
+		certmanager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(filepath.Join(datadir, ".autocert")),
+			HostPolicy: autocert.HostWhitelist(httpHost, "www."+httpHost),
+			Email:      acmeEmail,
+			Client:     &acme.Client{DirectoryURL: acmeDirectory, HTTPClient: client},
+		}
+		tlsConfig.GetCertificate = certmanager.GetCertificate
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto) // TLS-ALPN-01 challenges
+		redirHandler = certmanager.HTTPHandler(redir)
+		logger.Infof("ACME directory %s", acmeDirectory)
+	}
+
+	var servers []*http.Server
+	if httpRedirectAddr != "" {
+		httpd := &http.Server{
+			Handler:        redirHandler,
+			Addr:           httpRedirectAddr,
+			WriteTimeout:   httpTimeout,
+			ReadTimeout:    httpTimeout,
+			MaxHeaderBytes: maxHeaderBytes,
+		}
+		servers = append(servers, httpd)
+		go func() {
+			if err := httpd.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Fatalf("http server on %s failed: %s", httpRedirectAddr, err)
+			}
+		}()
+	}
+
 	// Override default for TLS.
 	if httpPort == "80" {
 		httpPort = "443"
@@ -346,6 +691,7 @@ func main() {
 	httpsd := &http.Server{
 		Handler:        r,
 		Addr:           httpAddr,
+		TLSConfig:      &tlsConfig,
 		WriteTimeout:   httpTimeout,
 		ReadTimeout:    httpTimeout,
 		MaxHeaderBytes: maxHeaderBytes,
@@ -357,7 +703,6 @@ func main() {
 		logger.Fatalf("listen failed: %s", err)
 		return
 	}
-	tlsListener := tls.NewListener(tcpKeepAliveListener{tcpListener.(*net.TCPListener)}, &tlsConfig)
 
 	hostport := net.JoinHostPort(httpHost, httpPort)
 	if httpPort == "443" {
@@ -366,10 +711,12 @@ func main() {
 	logger.Infof("Soundscape version: %s %s", version, &url.URL{
 		Scheme: "https",
 		Host:   hostport,
-		Path:   httpPrefix + "/",
+		Path:   URL("/"),
 	})
-	logger.Infof("Login credentials:  %s  /  %s", httpUsername, authsecret.Get())
-	logger.Fatal(httpsd.Serve(tlsListener))
+	// ServeTLS sets up HTTP/2 for the listener.
+	Serve(func() error {
+		return httpsd.ServeTLS(tcpKeepAliveListener{tcpListener.(*net.TCPListener)}, "", "")
+	}, append(servers, httpsd)...)
 }
 
 type tcpKeepAliveListener struct {
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/soundscapecloud/soundscape/internal/metrics"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	registry = metrics.NewRegistry()
+
+	httpRequests = registry.NewCounter("soundscape_http_requests_total",
+		"HTTP requests by route, method and status code.", "route", "method", "code")
+	httpDuration = registry.NewHistogram("soundscape_http_request_duration_seconds",
+		"HTTP request latencies by route and method.", metrics.DefaultBuckets, "route", "method")
+	streamedBytes = registry.NewCounter("soundscape_streamed_bytes_total",
+		"Bytes of audio sent to listeners, by kind (media, hls, radio or download).", "kind")
+
+	archiverJobGauge = registry.NewGauge("soundscape_archiver_jobs",
+		"Archiver jobs by state (queued, active or failed).", "state")
+	archiverPhaseDuration = registry.NewHistogram("soundscape_archiver_phase_duration_seconds",
+		"How long archiver job phases take; the job phase is the whole job.",
+		[]float64{0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}, "phase")
+	archiverFailures = registry.NewCounter("soundscape_archiver_failures_total",
+		"Failed archiver job phases, e.g. phase transcode for transcode failures.", "phase")
+
+	libraryMedia = registry.NewGauge("soundscape_library_media",
+		"Media in the library.")
+	libraryPlaylists = registry.NewGauge("soundscape_library_playlists",
+		"Playlists.")
+	libraryBytes = registry.NewGauge("soundscape_library_bytes",
+		"Size of the files in the data directory.")
+	diskBytes = registry.NewGauge("soundscape_disk_bytes",
+		"Disk space of the data directory's filesystem, by state (free, used or total).", "state")
+)
+
+// collectMetrics sets the gauges that are read when Prometheus scrapes.
+func collectMetrics() {
+	archiverJobGauge.Set(float64(len(archive.QueuedJobs())), "queued")
+	archiverJobGauge.Set(float64(len(archive.ActiveJobs())), "active")
+	archiverJobGauge.Set(float64(len(archive.FailedJobs())), "failed")
+
+	if medias, err := ListMedias(); err == nil {
+		libraryMedia.Set(float64(len(medias)))
+	}
+	if lists, err := ListLists(); err == nil {
+		libraryPlaylists.Set(float64(len(lists)))
+	}
+	if files, err := ioutil.ReadDir(datadir); err == nil {
+		var size int64
+		for _, f := range files {
+			if !f.IsDir() {
+				size += f.Size()
+			}
+		}
+		libraryBytes.Set(float64(size))
+	}
+	if d, err := NewDiskInfo(datadir); err == nil {
+		diskBytes.Set(float64(d.Free()), "free")
+		diskBytes.Set(float64(d.Used()), "used")
+		diskBytes.Set(float64(d.Total()), "total")
+	}
+}
+
+// archiverPhase records the timing of each archiver job phase.
+func archiverPhase(phase string, elapsed time.Duration, err error) {
+	archiverPhaseDuration.Observe(elapsed.Seconds(), phase)
+	if err != nil {
+		archiverFailures.Inc(phase)
+	}
+}
+
+// metricsHandler serves admins, with the metrics or admin scope if they use a token.
+func metricsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	u, err := users.Get(ps.ByName("user"))
+	if err != nil || !u.Admin {
+		httpError(w, r, http.StatusForbidden)
+		return
+	}
+	registry.ServeHTTP(w, r)
+}
+
+// routePattern turns the request's path back into its route, e.g.
+// /soundscape/media/view/abc into /media/view/:media, so metrics have a
+// label per route rather than per URL.
+func routePattern(r *http.Request, ps httprouter.Params) string {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, httpPrefix), "/")
+	i := 0
+	for _, p := range ps {
+		for j := i; j < len(parts); j++ {
+			if parts[j] == p.Value {
+				parts[j] = ":" + p.Key
+				i = j + 1
+				break
+			}
+		}
+	}
+	route := strings.Join(parts, "/")
+	if route == "" {
+		return "/"
+	}
+	return route
+}
+
+// statusWriter remembers the response's status code and size.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status is the response's status code, 200 if the handler didn't write anything.
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// streamWriter counts the audio bytes sent to listeners.
+type streamWriter struct {
+	http.ResponseWriter
+	kind string
+}
+
+func countStream(w http.ResponseWriter, kind string) http.ResponseWriter {
+	return &streamWriter{ResponseWriter: w, kind: kind}
+}
+
+func (w *streamWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	streamedBytes.Add(float64(n), w.kind)
+	return n, err
+}
+
+func (w *streamWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// csrfToken is the token the user's pages send with their forms and
+// requests. It's tied to the account, so it also works with Basic auth.
+func csrfToken(username string) string {
+	if username == "" {
+		return ""
+	}
+	return sessions.sign("csrf:" + username)
+}
+
+// checkCSRF makes sure a request that changes something came from one of our
+// pages. Browsers send cookies and Basic auth credentials along with requests
+// from any site, but only our pages have the token.
+func checkCSRF(r *http.Request, username string) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf")
+	}
+	if token != "" {
+		return hmac.Equal([]byte(token), []byte(csrfToken(username)))
+	}
+	// Scripts and Subsonic clients don't need the token; browsers always
+	// send one of these headers.
+	for _, header := range []string{"Origin", "Referer", "Sec-Fetch-Site", "Cookie"} {
+		if r.Header.Get(header) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSubsonicCSRF checks a Subsonic request that changes something, which
+// clients send with GET too. Browsers send the session cookie and Basic auth
+// credentials along by themselves, so those requests need the CSRF token;
+// API tokens and the u and p parameters can't be sent by another site.
+func checkSubsonicCSRF(r *http.Request, ps httprouter.Params) bool {
+	if ps.ByName("token") != "" {
+		return true
+	}
+	_, _, basic := r.BasicAuth()
+	if _, err := sessions.Get(r); err != nil && !basic && reverseProxyAuthIP == "" && r.FormValue("u") != "" {
+		return true
+	}
+	token := r.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = r.FormValue("csrf")
+	}
+	return token != "" && hmac.Equal([]byte(token), []byte(csrfToken(ps.ByName("user"))))
+}
+
+// csrfError rejects a request without a valid CSRF token.
+func csrfError(w http.ResponseWriter, r *http.Request, username string) {
+	logger.Warnf("rejected %s %s by %q from %q: missing or invalid CSRF token", r.Method, r.URL.Path, username, clientIP(r))
+	if isAPI(r) {
+		apiError(w, http.StatusForbidden, "missing or invalid CSRF token")
+		return
+	}
+	http.Error(w, "The page you came from has expired, go back, reload it and try again.", http.StatusForbidden)
+}
+
+// setCookie is http.SetCookie with SameSite=Lax, which http.Cookie can't
+// set in the Go version the release is built with.
+func setCookie(w http.ResponseWriter, cookie *http.Cookie) {
+	if v := cookie.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+"; SameSite=Lax")
+	}
+}
+
+// securityHeaders are set on HTML pages. Scripts must come from us or carry
+// the page's nonce; YouTube previews are the only frames.
+func securityHeaders(w http.ResponseWriter, nonce string) {
+	scripts := "'self'"
+	if nonce != "" {
+		scripts += " 'nonce-" + nonce + "'"
+	}
+	csp := []string{
+		"default-src 'self'",
+		"script-src " + scripts,
+		"style-src 'self' 'unsafe-inline'",
+		"img-src 'self' data:",
+		"font-src 'self' data:",
+		"media-src 'self' blob:",
+		"frame-src https://youtube.com https://www.youtube.com",
+		"object-src 'none'",
+		"base-uri 'self'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+	}
+	w.Header().Set("Content-Security-Policy", strings.Join(csp, "; "))
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+// newNonce returns a random nonce for a page's inline scripts.
+func newNonce() string {
+	nonce, err := RandomString(16)
+	if err != nil {
+		panic(fmt.Sprintf("generating a CSP nonce failed: %s", err))
+	}
+	return nonce
+}
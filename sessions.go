@@ -0,0 +1,219 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "soundscape_session"
+	oidcCookie    = "soundscape_oidc"
+
+	// How long a session lasts, without and with "remember me".
+	sessionTTL         = 12 * time.Hour
+	sessionRememberTTL = 30 * 24 * time.Hour
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+type Session struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Remember bool      `json:"remember"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Sessions are the logged in browsers. The cookie holds the session ID
+// signed with a key kept in the data directory.
+type Sessions struct {
+	sync.RWMutex
+	saving   sync.Mutex // one Save at a time, so an older snapshot can't overwrite a newer one
+	filename string
+	key      []byte
+
+	Sessions map[string]*Session `json:"sessions"`
+}
+
+func NewSessions(filename, keyfile string) (*Sessions, error) {
+	key, err := loadKey(filepath.Join(datadir, keyfile))
+	if err != nil {
+		return nil, err
+	}
+
+	filename = filepath.Join(datadir, filename)
+	s := &Sessions{
+		filename: filename,
+		key:      key,
+		Sessions: make(map[string]*Session),
+	}
+	b, err := ioutil.ReadFile(filename)
+
+	// Default for new store
+	if os.IsNotExist(err) {
+		return s, s.Save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Open existing store
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Sessions == nil {
+		s.Sessions = make(map[string]*Session)
+	}
+	return s, nil
+}
+
+// loadKey reads the signing key, creating it if necessary.
+func loadKey(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		key, err := RandomString(32)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(key), Overwrite(filename, []byte(key), 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(string(b))), nil
+}
+
+// Create starts a new session for the user and sets its cookie.
+func (s *Sessions) Create(w http.ResponseWriter, r *http.Request, username string, remember bool) (Session, error) {
+	id, err := RandomString(32)
+	if err != nil {
+		return Session{}, err
+	}
+	ttl := sessionTTL
+	if remember {
+		ttl = sessionRememberTTL
+	}
+	session := &Session{
+		ID:       id,
+		Username: username,
+		Remember: remember,
+		Created:  time.Now(),
+		Expires:  time.Now().Add(ttl),
+	}
+
+	s.Lock()
+	s.expire()
+	s.Sessions[id] = session
+	s.Unlock()
+	if err := s.Save(); err != nil {
+		return Session{}, err
+	}
+
+	cookie := &http.Cookie{
+		Name:     sessionCookie,
+		Value:    id + "." + s.sign(id),
+		Path:     URL("/"),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+	}
+	// Without "remember me" the cookie is gone when the browser closes.
+	if remember {
+		cookie.Expires = session.Expires
+	}
+	setCookie(w, cookie)
+	return *session, nil
+}
+
+// Get returns the session from the request's cookie.
+func (s *Sessions) Get(r *http.Request) (Session, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return Session{}, ErrSessionNotFound
+	}
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 || !hmac.Equal([]byte(parts[1]), []byte(s.sign(parts[0]))) {
+		return Session{}, ErrSessionNotFound
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+	session, ok := s.Sessions[parts[0]]
+	if !ok || time.Now().After(session.Expires) {
+		return Session{}, ErrSessionNotFound
+	}
+	return *session, nil
+}
+
+// Delete ends the request's session and clears its cookie.
+func (s *Sessions) Delete(w http.ResponseWriter, r *http.Request) error {
+	setCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     URL("/"),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		MaxAge:   -1,
+	})
+	session, err := s.Get(r)
+	if err != nil {
+		return nil
+	}
+	s.Lock()
+	delete(s.Sessions, session.ID)
+	s.Unlock()
+	return s.Save()
+}
+
+// DeleteUser ends all of a user's sessions.
+func (s *Sessions) DeleteUser(username string) error {
+	s.Lock()
+	for id, session := range s.Sessions {
+		if session.Username == username {
+			delete(s.Sessions, id)
+		}
+	}
+	s.Unlock()
+	return s.Save()
+}
+
+// expire drops expired sessions; the caller must hold the lock.
+func (s *Sessions) expire() {
+	now := time.Now()
+	for id, session := range s.Sessions {
+		if now.After(session.Expires) {
+			delete(s.Sessions, id)
+		}
+	}
+}
+
+func (s *Sessions) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Sessions) Save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	s.RLock()
+	b, err := json.MarshalIndent(s, "", "    ")
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+	return Overwrite(s.filename, b, 0600)
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
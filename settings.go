@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/soundscapecloud/soundscape/internal/archiver"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/julienschmidt/httprouter"
+	"go.uber.org/zap"
+)
+
+// Where a setting's value came from.
+const (
+	SourceDefault  = "default"
+	SourceFile     = "config file"
+	SourceEnv      = "environment"
+	SourceFlag     = "command line"
+	SourceSettings = "settings page"
+)
+
+// Environment variables are the flag names, e.g. SOUNDSCAPE_HTTP_HOST for --http-host.
+const envPrefix = "SOUNDSCAPE_"
+
+// RuntimeSettings are the flags that can be changed on the settings page
+// while Soundscape is running. The changes are saved in config.json and
+// override the other sources.
+var RuntimeSettings = []string{"archiver-bandwidth", "archiver-concurrency", "archiver-schedule", "debug", "min-free-space", "trash-retention"}
+
+var (
+	configFile     string
+	settingSources = make(map[string]string)
+
+	// settingsMu guards the runtime settings' flag variables and
+	// settingSources, which the settings page changes while requests and
+	// background jobs read them.
+	settingsMu sync.RWMutex
+
+	// SOUNDSCAPE_* variables that aren't settings, logged once there's a logger.
+	unknownEnv []string
+)
+
+// Setting is a flag, and where its value came from.
+type Setting struct {
+	Name    string
+	Env     string
+	Value   string
+	Default string
+	Usage   string
+	Source  string
+	Runtime bool
+	Bool    bool
+}
+
+// LoadSettings fills in the flags that weren't set on the command line from
+// SOUNDSCAPE_* environment variables, and then from the --config file.
+func LoadSettings() error {
+	cli.Visit(func(f *flag.Flag) {
+		settingSources[f.Name] = SourceFlag
+	})
+
+	// Unknown variables are remembered to warn about typos. They can't be
+	// errors: Kubernetes adds SOUNDSCAPE_PORT and friends for a Service
+	// named soundscape.
+	for _, kv := range os.Environ() {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !strings.HasPrefix(name, envPrefix) {
+			continue
+		}
+		f := cli.Lookup(flagName(name))
+		if f == nil {
+			unknownEnv = append(unknownEnv, name)
+			continue
+		}
+		if settingSources[f.Name] != "" {
+			continue
+		}
+		if err := cli.Set(f.Name, os.Getenv(name)); err != nil {
+			return fmt.Errorf("invalid %s: %s", name, err)
+		}
+		settingSources[f.Name] = SourceEnv
+	}
+
+	if configFile == "" {
+		return nil
+	}
+	values, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	for name, value := range values {
+		f := cli.Lookup(name)
+		if f == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", configFile, name)
+		}
+		if settingSources[f.Name] != "" {
+			continue
+		}
+		if err := cli.Set(f.Name, value); err != nil {
+			return fmt.Errorf("%s: invalid %s: %s", configFile, name, err)
+		}
+		settingSources[f.Name] = SourceFile
+	}
+	return nil
+}
+
+// readConfigFile reads a JSON object of flag names and values, e.g.
+// {"http-host": "music.example.com", "letsencrypt": true, "log-files": 5}.
+func readConfigFile(filename string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+	var raw map[string]interface{}
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	values := make(map[string]string)
+	for name, v := range raw {
+		switch v := v.(type) {
+		case string:
+			values[name] = v
+		case bool, json.Number:
+			values[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%s: %s must be a string, number or boolean", filename, name)
+		}
+	}
+	return values, nil
+}
+
+// ApplySavedSettings sets the runtime settings saved on the settings page.
+func ApplySavedSettings() error {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	for _, name := range unknownEnv {
+		logger.Warnf("ignoring environment variable %s: there's no --%s setting", name, flagName(name))
+	}
+	for name, value := range config.Get().Settings {
+		if !isRuntimeSetting(name) {
+			logger.Warnf("ignoring unknown saved setting %q", name)
+			continue
+		}
+		if err := cli.Set(name, value); err != nil {
+			return fmt.Errorf("invalid saved setting %s: %s", name, err)
+		}
+		settingSources[name] = SourceSettings
+	}
+	return applySettings()
+}
+
+// applySettings puts the runtime settings into effect. The caller must hold settingsMu.
+func applySettings() error {
+	n, err := humanize.ParseBytes(minFreeSpaceFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --min-free-space: %s", err)
+	}
+	if trashRetention < 0 {
+		return fmt.Errorf("the --trash-retention can't be negative")
+	}
+	if archiverConcurrency < 1 {
+		return fmt.Errorf("the --archiver-concurrency must be at least 1")
+	}
+	bandwidth, err := humanize.ParseBytes(archiverBandwidthFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --archiver-bandwidth: %s", err)
+	}
+	schedule, err := archiver.ParseSchedule(archiverScheduleFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --archiver-schedule: %s", err)
+	}
+	minFreeSpace = n
+	archiverBandwidth = bandwidth
+	archiverSchedule = schedule
+
+	// At startup the archiver is created with these afterwards.
+	if archive != nil {
+		archive.SetConcurrency(archiverConcurrency)
+		archive.SetBandwidth(int64(archiverBandwidth))
+		archive.SetSchedule(archiverSchedule)
+	}
+	if debug {
+		logLevel.SetLevel(zap.DebugLevel)
+	} else {
+		logLevel.SetLevel(zap.InfoLevel)
+	}
+	return nil
+}
+
+// ChangeSetting changes a runtime setting and saves it, keeping the old value if the new one is invalid.
+func ChangeSetting(name, value string) error {
+	if !isRuntimeSetting(name) {
+		return fmt.Errorf("%s can't be changed while running", name)
+	}
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	f := cli.Lookup(name)
+	old := f.Value.String()
+	if err := cli.Set(name, value); err != nil {
+		return fmt.Errorf("invalid %s: %s", name, err)
+	}
+	if err := applySettings(); err != nil {
+		cli.Set(name, old)
+		applySettings()
+		return err
+	}
+	settingSources[name] = SourceSettings
+	return config.SetSetting(name, f.Value.String())
+}
+
+// TrashRetention is how long deleted media and playlists are kept in the trash.
+func TrashRetention() time.Duration {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return trashRetention
+}
+
+// MinFreeSpace is the free disk space below which /readyz fails.
+func MinFreeSpace() uint64 {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	return minFreeSpace
+}
+
+func isRuntimeSetting(name string) bool {
+	for _, s := range RuntimeSettings {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Settings returns every flag, sorted by name, with secrets hidden.
+func Settings() []Setting {
+	settingsMu.RLock()
+	defer settingsMu.RUnlock()
+	var settings []Setting
+	cli.VisitAll(func(f *flag.Flag) {
+		s := Setting{
+			Name:    f.Name,
+			Env:     envName(f.Name),
+			Value:   f.Value.String(),
+			Default: f.DefValue,
+			Usage:   f.Usage,
+			Source:  settingSources[f.Name],
+			Runtime: isRuntimeSetting(f.Name),
+		}
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			s.Bool = b.IsBoolFlag()
+		}
+		if s.Source == "" {
+			s.Source = SourceDefault
+		}
+		if strings.Contains(f.Name, "secret") && s.Value != "" {
+			s.Value = "********"
+		}
+		settings = append(settings, s)
+	})
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Name < settings[j].Name })
+	return settings
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func flagName(envName string) string {
+	return strings.ToLower(strings.Replace(strings.TrimPrefix(envName, envPrefix), "_", "-", -1))
+}
+
+//
+// Handlers
+//
+
+func settingsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	res := NewResponse(r, ps)
+	res.Settings = Settings()
+	res.Section = "settings"
+	HTML(w, "settings.html", res)
+}
+
+func saveSettings(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	for _, s := range Settings() {
+		if !s.Runtime {
+			continue
+		}
+		value := strings.TrimSpace(r.FormValue(s.Name))
+		if s.Bool {
+			value = fmt.Sprint(value == "on")
+		}
+		if value == s.Value {
+			continue
+		}
+		if err := ChangeSetting(s.Name, value); err != nil {
+			res := NewResponse(r, ps)
+			res.Settings = Settings()
+			res.Section = "settings"
+			res.Error = err.Error()
+			HTML(w, "settings.html", res)
+			return
+		}
+		logger.Infof("user %q changed %s from %q to %q", ps.ByName("user"), s.Name, s.Value, value)
+		audit.Record(r, ps, "edit", "setting", s.Name, s.Value+" → "+value)
+	}
+	Redirect(w, r, "/settings?message=settingssaved")
+}
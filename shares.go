@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Playlists used to be public at /play/<playlist id>. Upgrading keeps
+// those links working for this long, as shares with the playlist's ID,
+// so they can be replaced with share links of their own.
+const legacyShareTTL = 30 * 24 * time.Hour
+
+// How often views are written to disk; radio and podcast clients view a
+// share on every request.
+const shareViewInterval = time.Minute
+
+var (
+	ErrShareNotFound = errors.New("share not found")
+	ErrShareExpired  = errors.New("share expired")
+	ErrShareLocked   = errors.New("share is password protected")
+)
+
+// Share is a public link to a playlist or a single song.
+type Share struct {
+	ID       string    `json:"id"`
+	ListID   string    `json:"list_id,omitempty"`
+	MediaID  string    `json:"media_id,omitempty"`
+	Owner    string    `json:"owner"`
+	Password string    `json:"password,omitempty"` // bcrypt hash
+	Download bool      `json:"download"`
+	Radio    bool      `json:"radio,omitempty"` // only streams the playlist's radio station
+	Views    int64     `json:"views"`
+	Viewed   time.Time `json:"viewed"` // zero if it never was
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"` // zero for never
+}
+
+func (s Share) Expired() bool {
+	return !s.Expires.IsZero() && time.Now().After(s.Expires)
+}
+
+func (s Share) HasPassword() bool {
+	return s.Password != ""
+}
+
+func (s Share) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(s.Password), []byte(password)) == nil
+}
+
+// List returns the shared playlist, or a playlist of just the shared song.
+func (s Share) List() (*List, error) {
+	if s.MediaID == "" {
+		return FindList(s.ListID)
+	}
+	media, err := FindMedia(s.MediaID)
+	if err != nil {
+		return nil, err
+	}
+	return &List{
+		ID:       s.ID,
+		Title:    media.Title,
+		Owner:    s.Owner,
+		Created:  s.Created,
+		Modified: media.Created,
+		Medias:   []*Media{media},
+	}, nil
+}
+
+// Shares are persisted as a single JSON file.
+type Shares struct {
+	sync.RWMutex
+	saving   sync.Mutex // one Save at a time, so an older snapshot can't overwrite a newer one
+	filename string
+
+	Shares map[string]*Share `json:"shares"`
+
+	// when the views were last written to disk
+	viewsSaved time.Time
+}
+
+func NewShares(filename string) (*Shares, error) {
+	filename = filepath.Join(datadir, filename)
+	s := &Shares{
+		filename: filename,
+		Shares:   make(map[string]*Share),
+	}
+	b, err := ioutil.ReadFile(filename)
+
+	// Default for new store, keeping the links to the playlists made before
+	// the upgrade working for a while. Playlists made by this start (such as
+	// the default one of a new install) were never public.
+	if os.IsNotExist(err) {
+		lists, err := ListLists()
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for _, list := range lists {
+			if !list.Created.Before(startTime) {
+				continue
+			}
+			s.Shares[list.ID] = &Share{
+				ID:      list.ID,
+				ListID:  list.ID,
+				Owner:   list.Owner,
+				Created: now,
+				Expires: now.Add(legacyShareTTL),
+			}
+			logger.Warnf("playlist %q was public at /play/%s; the link now expires on %s", list.Title, list.ID, now.Add(legacyShareTTL).Format("2006-01-02"))
+		}
+		return s, s.Save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Open existing store
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Shares == nil {
+		s.Shares = make(map[string]*Share)
+	}
+	return s, nil
+}
+
+// Create shares a playlist (or a song, if mediaID is set).
+func (s *Shares) Create(owner, listID, mediaID, password string, download bool, ttl time.Duration) (Share, error) {
+	id, err := RandomString(16)
+	if err != nil {
+		return Share{}, err
+	}
+	share := &Share{
+		ID:       id,
+		ListID:   listID,
+		MediaID:  mediaID,
+		Owner:    owner,
+		Download: download,
+		Created:  time.Now(),
+	}
+	if mediaID != "" {
+		share.ListID = ""
+	}
+	if ttl > 0 {
+		share.Expires = share.Created.Add(ttl)
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return Share{}, err
+		}
+		share.Password = string(hash)
+	}
+
+	s.Lock()
+	s.Shares[id] = share
+	s.Unlock()
+	return *share, s.Save()
+}
+
+// Radio returns the user's radio share of a playlist, creating it the first
+// time. Subsonic clients are given its link instead of the user's password,
+// and it can be revoked on the shares page like any other.
+func (s *Shares) Radio(owner, listID string) (Share, error) {
+	s.Lock()
+	for _, share := range s.Shares {
+		if share.Radio && share.Owner == owner && share.ListID == listID {
+			s.Unlock()
+			return *share, nil
+		}
+	}
+	id, err := RandomString(16)
+	if err != nil {
+		s.Unlock()
+		return Share{}, err
+	}
+	share := &Share{
+		ID:      id,
+		ListID:  listID,
+		Owner:   owner,
+		Radio:   true,
+		Created: time.Now(),
+	}
+	s.Shares[id] = share
+	s.Unlock()
+	return *share, s.Save()
+}
+
+func (s *Shares) Get(id string) (Share, error) {
+	s.RLock()
+	defer s.RUnlock()
+	share, ok := s.Shares[id]
+	if !ok {
+		return Share{}, ErrShareNotFound
+	}
+	return *share, nil
+}
+
+// Find returns the share for id, if it's still valid.
+func (s *Shares) Find(id string) (Share, error) {
+	share, err := s.Get(id)
+	if err != nil {
+		return Share{}, err
+	}
+	if share.Expired() {
+		return Share{}, ErrShareExpired
+	}
+	return share, nil
+}
+
+// Unlocked reports whether the request may use the share, either because it
+// has no password, or the password was entered or sent with basic auth.
+func (s *Shares) Unlocked(r *http.Request, share Share) bool {
+	if !share.HasPassword() {
+		return true
+	}
+	if cookie, err := r.Cookie(shareCookie(share.ID)); err == nil && cookie.Value == sessions.sign("share:"+share.ID+share.Password) {
+		return true
+	}
+	if _, password, ok := r.BasicAuth(); ok && share.CheckPassword(password) {
+		return true
+	}
+	return false
+}
+
+// Grant remembers that the browser entered the share's password.
+func (s *Shares) Grant(w http.ResponseWriter, r *http.Request, share Share) {
+	setCookie(w, &http.Cookie{
+		Name:     shareCookie(share.ID),
+		Value:    sessions.sign("share:" + share.ID + share.Password),
+		Path:     URL("/"),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+	})
+}
+
+// View counts a visit to the share. Views are saved with the next change, or
+// at most once every shareViewInterval.
+func (s *Shares) View(id string) error {
+	s.Lock()
+	share, ok := s.Shares[id]
+	if !ok {
+		s.Unlock()
+		return ErrShareNotFound
+	}
+	share.Views++
+	share.Viewed = time.Now()
+	save := time.Since(s.viewsSaved) > shareViewInterval
+	if save {
+		s.viewsSaved = time.Now()
+	}
+	s.Unlock()
+
+	if save {
+		return s.Save()
+	}
+	return nil
+}
+
+// List returns copies of the user's shares, newest first. If listID or
+// mediaID are set, only the shares of that playlist or song are returned.
+func (s *Shares) List(owner, listID, mediaID string) []Share {
+	s.RLock()
+	defer s.RUnlock()
+	var shares []Share
+	for _, share := range s.Shares {
+		if share.Owner != owner {
+			continue
+		}
+		if listID != "" && share.ListID != listID {
+			continue
+		}
+		if mediaID != "" && share.MediaID != mediaID {
+			continue
+		}
+		shares = append(shares, *share)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Created.After(shares[j].Created)
+	})
+	return shares
+}
+
+// Revoke deletes a share. Admins can revoke anybody's shares.
+func (s *Shares) Revoke(u User, id string) error {
+	s.Lock()
+	share, ok := s.Shares[id]
+	if !ok || (share.Owner != u.Username && !u.Admin) {
+		s.Unlock()
+		return ErrShareNotFound
+	}
+	delete(s.Shares, id)
+	s.Unlock()
+	return s.Save()
+}
+
+// DeleteList revokes the shares of a deleted playlist, returning them.
+func (s *Shares) DeleteList(listID string) ([]Share, error) {
+	s.Lock()
+	var revoked []Share
+	for id, share := range s.Shares {
+		if share.ListID == listID {
+			revoked = append(revoked, *share)
+			delete(s.Shares, id)
+		}
+	}
+	s.Unlock()
+	return revoked, s.Save()
+}
+
+// DeleteMedia revokes the shares of a deleted song, returning them.
+func (s *Shares) DeleteMedia(mediaID string) ([]Share, error) {
+	s.Lock()
+	var revoked []Share
+	for id, share := range s.Shares {
+		if share.MediaID == mediaID {
+			revoked = append(revoked, *share)
+			delete(s.Shares, id)
+		}
+	}
+	s.Unlock()
+	return revoked, s.Save()
+}
+
+// Restore brings back shares revoked by a deletion.
+func (s *Shares) Restore(restored []Share) error {
+	if len(restored) == 0 {
+		return nil
+	}
+	s.Lock()
+	for i := range restored {
+		share := restored[i]
+		s.Shares[share.ID] = &share
+	}
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *Shares) Save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	s.RLock()
+	b, err := json.MarshalIndent(s, "", "    ")
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+	return Overwrite(s.filename, b, 0600)
+}
+
+func shareCookie(id string) string {
+	return "soundscape_share_" + id
+}
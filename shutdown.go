@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/soundscapecloud/soundscape/internal/archiver"
+)
+
+// The archiver jobs that were interrupted or still queued at shutdown.
+const pendingJobsFile = "archiver.json"
+
+// Serve runs start (e.g. the server's ListenAndServe) until it fails, or
+// until SIGINT or SIGTERM, then shuts the servers down gracefully.
+func Serve(start func() error, servers ...*http.Server) {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- start()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errs:
+		logger.Fatal(err)
+	case sig := <-signals:
+		logger.Infof("received %s, shutting down (waiting up to %s)", sig, shutdownTimeout)
+	}
+	signal.Stop(signals)
+	Shutdown(servers...)
+}
+
+// Shutdown stops accepting requests, lets the ones in flight and the
+// archiver jobs finish within the shutdown timeout, and saves the jobs that
+// didn't so they're resumed on the next start.
+func Shutdown(servers ...*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				logger.Warnf("http server %s: closing the remaining connections: %s", srv.Addr, err)
+				srv.Close()
+			}
+		}(srv)
+	}
+
+	// Radio listeners and log followers never go idle, so they're disconnected right away.
+	stations.Stop()
+	logtail.CloseSubscribers()
+
+	pending := archive.Shutdown(ctx)
+	if err := savePendingJobs(pending); err != nil {
+		logger.Errorf("saving %d unfinished archiver jobs failed: %s", len(pending), err)
+	} else if len(pending) > 0 {
+		logger.Infof("saved %d unfinished archiver jobs, they'll resume on the next start", len(pending))
+	}
+
+	wg.Wait()
+
+	// The share views counted since they were last saved.
+	if err := shares.Save(); err != nil {
+		logger.Errorf("saving shares failed: %s", err)
+	}
+	logger.Infof("shutdown complete")
+	logger.Sync()
+}
+
+func savePendingJobs(jobs []archiver.PendingJob) error {
+	filename := filepath.Join(datadir, pendingJobsFile)
+	if len(jobs) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	b, err := json.MarshalIndent(jobs, "", "    ")
+	if err != nil {
+		return err
+	}
+	return Overwrite(filename, b, 0600)
+}
+
+// ResumePendingJobs adds the jobs saved at the last shutdown back to the archiver.
+func ResumePendingJobs() error {
+	filename := filepath.Join(datadir, pendingJobsFile)
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var jobs []archiver.PendingJob
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		// Deleted while the server was down.
+		if _, err := loadMedia(job.ID); err != nil {
+			continue
+		}
+		logger.Infof("resuming archiver job %q", job.ID)
+		archive.Add(job.ID, job.Source, job.RequestID, job.Priority)
+	}
+	return os.Remove(filename)
+}
@@ -1,19 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
 	"strings"
 	"time"
+
+	"github.com/soundscapecloud/soundscape/internal/archiver"
 )
 
-var ErrMediaNotFound = errors.New("media not found")
+var (
+	ErrMediaNotFound = errors.New("media not found")
+	ErrListNotFound  = errors.New("playlist not found")
+	ErrInvalidOrder  = errors.New("the new order must have each of the playlist's media exactly once")
+	ErrAlreadySplit  = errors.New("the media was split into tracks before; delete them to split it again")
+)
 
 //
 // Media
@@ -22,11 +31,24 @@ type Media struct {
 	ID          string    `json:"id"`
 	Author      string    `json:"author"`
 	Title       string    `json:"title"`
+	Album       string    `json:"album"`
 	Description string    `json:"description"`
 	Length      int64     `json:"length"` // In seconds
 	Source      string    `json:"source"`
 	Modified    time.Time `json:"modified"`
 	Created     time.Time `json:"created"`
+
+	// The user who imported it, and whether it's hidden from everyone else.
+	Owner   string `json:"owner"`
+	Private bool   `json:"private"`
+
+	// ReplayGain, measured when archived.
+	TrackGain float64 `json:"track_gain"` // In dB
+	TrackPeak float64 `json:"track_peak"` // Linear, 1.0 is full scale
+
+	// Trimmed positions in the source audio, in seconds (TrimEnd 0 is the end).
+	TrimStart float64 `json:"trim_start"`
+	TrimEnd   float64 `json:"trim_end"`
 }
 
 func mediaFile(id string) string {
@@ -36,15 +58,17 @@ func mediaFile(id string) string {
 	return filepath.Join(datadir, id+".media")
 }
 
-func NewMedia(id, author, title string, length int64, source string) (*Media, error) {
+func NewMedia(id, author, title, description string, length int64, source, owner string) (*Media, error) {
 	media := &Media{
-		ID:       id,
-		Author:   author,
-		Title:    title,
-		Length:   length,
-		Source:   source,
-		Modified: time.Now(),
-		Created:  time.Now(),
+		ID:          id,
+		Author:      author,
+		Title:       title,
+		Description: description,
+		Length:      length,
+		Source:      source,
+		Owner:       owner,
+		Modified:    time.Now(),
+		Created:     time.Now(),
 	}
 	return media, media.Save()
 }
@@ -62,6 +86,39 @@ func QueuedMedias() []*Media {
 	return medias
 }
 
+// Archived is called by the archiver when a job completes successfully.
+func Archived(result archiver.Result) {
+	media, err := loadMedia(result.ID)
+	if err != nil {
+		logger.Errorf("failed to find media for archived job %q: %s", result.ID, err)
+		return
+	}
+	if l := result.Loudness; l != nil {
+		media.TrackGain = l.TrackGain()
+		media.TrackPeak = l.TrackPeak()
+		logger.Debugf("media %q loudness %.1f LUFS gain %.2f dB peak %.3f", media.ID, l.Integrated, media.TrackGain, media.TrackPeak)
+	}
+	media.TrimStart = result.TrimStart
+	media.TrimEnd = result.TrimEnd
+	if result.Length > 0 {
+		media.Length = int64(result.Length)
+	}
+	media.Modified = time.Now()
+	if err := media.Save(); err != nil {
+		logger.Error(err)
+		return
+	}
+
+	if len(result.Chapters) > 0 {
+		list, err := media.Split(context.Background(), result.Chapters)
+		if err != nil {
+			logger.Errorf("splitting media %q failed: %s", media.ID, err)
+			return
+		}
+		logger.Infof("split media %q into %d tracks in playlist %q", media.ID, len(list.Medias), list.ID)
+	}
+}
+
 func ActiveMedias() []*Media {
 	var medias []*Media
 	for _, id := range archive.ActiveJobs() {
@@ -75,47 +132,219 @@ func ActiveMedias() []*Media {
 	return medias
 }
 
-func DeleteMedia(id string) error {
+func FailedMedias() []*Media {
+	var medias []*Media
+	for _, id := range archive.FailedJobs() {
+		m, err := loadMedia(id)
+		if err != nil {
+			continue
+		}
+		medias = append(medias, m)
+	}
+	return medias
+}
+
+// CancelImport cancels the job archiving a media, queued or active, and
+// removes the media if it has no audio yet: right away for a queued job, and
+// once it has stopped for an active one (see Archiver.OnCancel). It returns
+// false if there's no job.
+func CancelImport(id string) bool {
+	if !archive.Remove(id) {
+		return false
+	}
+	removeUnarchived(id)
+	return true
+}
+
+// CancelImports cancels every archiver job, and returns their IDs.
+func CancelImports() []string {
+	ids := archive.CancelAll()
+	for _, id := range ids {
+		removeUnarchived(id)
+	}
+	return ids
+}
+
+// ClearFailedImports forgets the failed archiver jobs and removes what they
+// left behind, and returns their IDs.
+func ClearFailedImports() []string {
+	ids := archive.ClearFailed()
+	for _, id := range ids {
+		removeUnarchived(id)
+	}
+	return ids
+}
+
+// removeUnarchived removes the media created for an import that didn't
+// finish, unless its audio was archived before (e.g. it was imported again)
+// or its job is still running.
+func removeUnarchived(id string) {
+	media, err := loadMedia(id)
+	if err != nil {
+		return
+	}
+	if media.HasAudio() || archive.InProgress(id) {
+		return
+	}
+	if err := os.Remove(media.File()); err != nil {
+		logger.Errorf("removing media %q failed: %s", id, err)
+		return
+	}
+	logger.Infof("removed media %q, its import didn't finish", id)
+}
+
+// DeleteMedia moves the media to the trash, returning the trash item ID,
+// or removes it right away if the trash is disabled.
+func DeleteMedia(id, deletedBy string) (string, error) {
 	media, err := FindMedia(id)
 	if err != nil {
-		return nil
+		return "", nil
 	}
 
-	// Remove all list references to this media.
+	// The playlists it's in, taken out of them once it's gone.
 	lists, err := ListLists()
 	if err != nil {
-		return err
+		return "", err
 	}
+	var memberships []TrashMembership
+	var inLists []*List
 	for _, l := range lists {
-		if err := l.RemoveMedia(media); err != nil {
-			return err
+		for i, m := range l.Medias {
+			if m.ID == media.ID {
+				memberships = append(memberships, TrashMembership{ListID: l.ID, Position: i})
+				inLists = append(inLists, l)
+				break
+			}
 		}
 	}
 
-	// Remove all media files.
-	files := []string{
-		media.ImageFile(),
-		media.VideoFile(),
-		media.AudioFile(),
-		media.File(),
+	revoked, err := shares.DeleteMedia(media.ID)
+	if err != nil {
+		return "", err
 	}
-	for _, f := range files {
-		if _, err := os.Stat(f); os.IsNotExist(err) {
-			continue
+
+	var trashID string
+	if TrashRetention() > 0 {
+		t, err := TrashMedia(media, memberships, revoked, deletedBy)
+		if err != nil {
+			if rerr := shares.Restore(revoked); rerr != nil {
+				logger.Error(rerr)
+			}
+			return "", err
 		}
-		if err := os.Remove(f); err != nil {
-			return err
+		trashID = t.ID
+	} else {
+		// Remove all media files, and the HLS segments.
+		if err := os.RemoveAll(media.HLSDir()); err != nil {
+			return "", err
+		}
+		files := []string{
+			media.ImageFile(),
+			media.VideoFile(),
+			media.AudioFile(),
+			media.SourceFile(),
+			media.File(),
+		}
+		for _, f := range files {
+			if _, err := os.Stat(f); os.IsNotExist(err) {
+				continue
+			}
+			if err := os.Remove(f); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	for _, share := range revoked {
+		stations.StopStation(share.ID)
+	}
+	for _, l := range inLists {
+		if err := l.RemoveMedia(media); err != nil {
+			return trashID, err
 		}
 	}
-	return nil
+	return trashID, nil
 }
 
-func DeleteList(id string) error {
+// DeleteList moves the playlist to the trash, returning the trash item ID,
+// or removes it right away if the trash is disabled.
+func DeleteList(id, deletedBy string) (string, error) {
 	list, err := FindList(id)
 	if err != nil {
-		return err
+		return "", err
+	}
+	revoked, err := shares.DeleteList(list.ID)
+	if err != nil {
+		return "", err
+	}
+	var trashID string
+	if TrashRetention() > 0 {
+		t, err := TrashList(list, revoked, deletedBy)
+		if err != nil {
+			if rerr := shares.Restore(revoked); rerr != nil {
+				logger.Error(rerr)
+			}
+			return "", err
+		}
+		trashID = t.ID
+	} else if err := os.Remove(list.File()); err != nil {
+		return "", err
+	}
+	for _, share := range revoked {
+		stations.StopStation(share.ID)
 	}
-	return os.Remove(list.File())
+	return trashID, nil
+}
+
+// ReassignOwner gives the media and playlists that belong to one user to
+// another, so a deleted user's private ones aren't left where nobody can see
+// them. It returns how many of each it changed.
+func ReassignOwner(from, to string) (medias, lists int, err error) {
+	files, err := ioutil.ReadDir(datadir)
+	if err != nil {
+		return 0, 0, err
+	}
+	// One unreadable file mustn't stop the rest being reassigned.
+	var failed []string
+	for _, f := range files {
+		id := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		switch filepath.Ext(f.Name()) {
+		case ".media":
+			m, err := loadMedia(id)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("media %s: %s", id, err))
+				continue
+			}
+			if m.Owner != from {
+				continue
+			}
+			m.Owner = to
+			if err := m.Save(); err != nil {
+				failed = append(failed, fmt.Sprintf("media %s: %s", id, err))
+				continue
+			}
+			medias++
+		case ".playlist":
+			l, err := FindList(id)
+			if err != nil {
+				failed = append(failed, fmt.Sprintf("playlist %s: %s", id, err))
+				continue
+			}
+			if l.Owner != from {
+				continue
+			}
+			l.Owner = to
+			if err := l.Save(); err != nil {
+				failed = append(failed, fmt.Sprintf("playlist %s: %s", id, err))
+				continue
+			}
+			lists++
+		}
+	}
+	if len(failed) > 0 {
+		return medias, lists, fmt.Errorf("reassigning %s's media and playlists failed: %s", from, strings.Join(failed, "; "))
+	}
+	return medias, lists, nil
 }
 
 func FindMedia(id string) (*Media, error) {
@@ -131,6 +360,57 @@ func FindMedia(id string) (*Media, error) {
 	return nil, ErrMediaNotFound
 }
 
+// FindUserMedia finds media that the user is allowed to see.
+func FindUserMedia(id, username string) (*Media, error) {
+	media, err := FindMedia(id)
+	if err != nil {
+		return nil, err
+	}
+	if !media.VisibleTo(username) {
+		return nil, ErrMediaNotFound
+	}
+	return media, nil
+}
+
+// VisibleMedias keeps the media the user is allowed to see.
+func VisibleMedias(medias []*Media, username string) []*Media {
+	var visible []*Media
+	for _, m := range medias {
+		if m.VisibleTo(username) {
+			visible = append(visible, m)
+		}
+	}
+	return visible
+}
+
+// UserMedias returns the library, without other users' private media.
+func UserMedias(username string) ([]*Media, error) {
+	medias, err := ListMedias()
+	if err != nil {
+		return nil, err
+	}
+	return VisibleMedias(medias, username), nil
+}
+
+// SearchMedias returns the media whose title, description, author or source contain the query.
+func SearchMedias(medias []*Media, query string) []*Media {
+	if query == "" {
+		return medias
+	}
+	var filtered []*Media
+	for _, m := range medias {
+		content := m.Title
+		content += m.Description
+		content += m.Author
+		content += m.Source
+		if !strings.Contains(strings.ToLower(content), strings.ToLower(query)) {
+			continue
+		}
+		filtered = append(filtered, m)
+	}
+	return filtered
+}
+
 func loadMedia(id string) (*Media, error) {
 	b, err := ioutil.ReadFile(mediaFile(id))
 	if err != nil {
@@ -196,6 +476,182 @@ func (m Media) AudioFile() string {
 	return filepath.Join(datadir, m.ID+".m4a")
 }
 
+// SourceFile is the untrimmed audio, kept so the media can be re-cut.
+func (m Media) SourceFile() string {
+	return filepath.Join(datadir, m.ID+".source.m4a")
+}
+
+func (m Media) HLSDir() string {
+	return filepath.Join(datadir, m.ID+".hls")
+}
+
+func (m Media) HasSource() bool {
+	_, err := os.Stat(m.SourceFile())
+	return err == nil
+}
+
+func (m Media) IsTrimmed() bool {
+	return m.TrimStart > 0 || m.TrimEnd > 0
+}
+
+// Trim re-cuts the audio from the source, or restores the source if start and end are 0.
+func (m *Media) Trim(ctx context.Context, start, end float64) error {
+	if start < 0 || end < 0 || (end != 0 && end <= start) {
+		return fmt.Errorf("invalid trim: start %.2f, end %.2f", start, end)
+	}
+	switch {
+	case start == 0 && end == 0:
+		if m.HasSource() {
+			if err := os.Rename(m.SourceFile(), m.AudioFile()); err != nil {
+				return err
+			}
+		}
+	case m.HasSource():
+		if err := archiver.Trim(ctx, m.SourceFile(), m.AudioFile(), start, end); err != nil {
+			return err
+		}
+	default:
+		// The untrimmed audio only becomes the source once the cut worked.
+		trimmed := m.AudioFile() + ".trimmed"
+		if err := archiver.Trim(ctx, m.AudioFile(), trimmed, start, end); err != nil {
+			os.Remove(trimmed)
+			return err
+		}
+		if err := os.Rename(m.AudioFile(), m.SourceFile()); err != nil {
+			os.Remove(trimmed)
+			return err
+		}
+		if err := os.Rename(trimmed, m.AudioFile()); err != nil {
+			os.Rename(m.SourceFile(), m.AudioFile())
+			os.Remove(trimmed)
+			return err
+		}
+	}
+
+	// Cached segments are for the old cut.
+	if err := os.RemoveAll(m.HLSDir()); err != nil {
+		return err
+	}
+
+	length, err := archiver.Duration(ctx, m.AudioFile())
+	if err != nil {
+		return err
+	}
+	m.Length = int64(length)
+	// The gain is for what's played, without the silence that was cut.
+	if l, err := archiver.MeasureLoudness(ctx, m.AudioFile()); err == nil {
+		m.TrackGain = l.TrackGain()
+		m.TrackPeak = l.TrackPeak()
+	}
+	m.TrimStart = start
+	m.TrimEnd = end
+	m.Modified = time.Now()
+	return m.Save()
+}
+
+// Split cuts the media into a new media per chapter, collected in a new list in order.
+// Chapters are positioned in the untrimmed source audio. If a track fails,
+// the tracks and list made so far are removed.
+func (m *Media) Split(ctx context.Context, chapters []archiver.Chapter) (list *List, err error) {
+	source := m.AudioFile()
+	if m.HasSource() {
+		source = m.SourceFile()
+	}
+
+	// The tracks are named after the media, so splitting again would replace them.
+	var tracks []*Media
+	for i := range chapters {
+		track := &Media{ID: fmt.Sprintf("%s-%02d", m.ID, i+1)}
+		if _, err := os.Stat(track.File()); err == nil {
+			return nil, ErrAlreadySplit
+		}
+		tracks = append(tracks, track)
+	}
+
+	list, err = NewList(m.Title, m.Owner)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, track := range tracks {
+			for _, f := range []string{track.File(), track.AudioFile(), track.ImageFile()} {
+				os.Remove(f)
+			}
+		}
+		os.Remove(list.File())
+		list = nil
+	}()
+
+	for i, c := range chapters {
+		title := c.Title
+		if title == "" {
+			title = fmt.Sprintf("%s (part %d)", m.Title, i+1)
+		}
+		track := tracks[i]
+		*track = Media{
+			ID:        track.ID,
+			Author:    m.Author,
+			Title:     title,
+			Album:     m.Title,
+			Source:    m.Source,
+			Owner:     m.Owner,
+			Private:   m.Private,
+			TrackGain: m.TrackGain,
+			TrackPeak: m.TrackPeak,
+			Modified:  time.Now(),
+			Created:   time.Now(),
+		}
+		if err := archiver.Trim(ctx, source, track.AudioFile(), c.Start, c.End); err != nil {
+			return nil, err
+		}
+		if length, err := archiver.Duration(ctx, track.AudioFile()); err == nil {
+			track.Length = int64(length)
+		}
+		if l, err := archiver.MeasureLoudness(ctx, track.AudioFile()); err == nil {
+			track.TrackGain = l.TrackGain()
+			track.TrackPeak = l.TrackPeak()
+		}
+		if err := CopyFile(m.ImageFile(), track.ImageFile()); err != nil {
+			return nil, err
+		}
+		if err := track.Save(); err != nil {
+			return nil, err
+		}
+		list.Medias = append(list.Medias, track)
+	}
+	return list, list.Save()
+}
+
+func (m Media) VisibleTo(username string) bool {
+	return m.Owner == "" || !m.Private || m.Owner == username
+}
+
+// EditableBy reports whether the user may change the media. Media imported
+// before there were users has no owner, so only admins may change it.
+func (m Media) EditableBy(u User) bool {
+	return m.Owner == u.Username || u.Admin
+}
+
+func (m Media) HasGain() bool {
+	return m.TrackPeak > 0
+}
+
+// GainFactor is the linear volume adjustment for the track gain, limited so
+// the track peak doesn't clip.
+func (m Media) GainFactor() float64 {
+	if !m.HasGain() {
+		return 1
+	}
+	factor := math.Pow(10, m.TrackGain/20)
+	if factor*m.TrackPeak > 1 {
+		factor = 1 / m.TrackPeak
+	}
+	return factor
+}
+
 func (m Media) HasImage() bool {
 	_, err := os.Stat(m.ImageFile())
 	return err == nil
@@ -220,6 +676,11 @@ type List struct {
 
 	Medias []*Media `json:"medias"`
 
+	RadioShuffle bool `json:"radio_shuffle"`
+
+	// The user the playlist belongs to, or empty if it's shared with everyone.
+	Owner string `json:"owner"`
+
 	Modified time.Time `json:"modified"`
 	Created  time.Time `json:"created"`
 }
@@ -231,7 +692,7 @@ func listFile(id string) string {
 	return filepath.Join(datadir, id+".playlist")
 }
 
-func NewList(title string) (*List, error) {
+func NewList(title, owner string) (*List, error) {
 	id, err := RandomNumber()
 	if err != nil {
 		return nil, err
@@ -239,6 +700,7 @@ func NewList(title string) (*List, error) {
 	list := &List{
 		ID:       fmt.Sprintf("%d", id),
 		Title:    title,
+		Owner:    owner,
 		Modified: time.Now(),
 		Created:  time.Now(),
 	}
@@ -258,6 +720,16 @@ func (l *List) Save() error {
 	return Overwrite(l.File(), b, 0644)
 }
 
+func (l *List) VisibleTo(username string) bool {
+	return l.Owner == "" || l.Owner == username
+}
+
+// EditableBy reports whether the user may change the list. Everybody can see
+// the playlists from before there were users, but only admins change them.
+func (l *List) EditableBy(u User) bool {
+	return l.Owner == u.Username || (l.Owner == "" && u.Admin)
+}
+
 func (l *List) HasMedia(media *Media) bool {
 	for _, m := range l.Medias {
 		if m.ID == media.ID {
@@ -267,6 +739,15 @@ func (l *List) HasMedia(media *Media) bool {
 	return false
 }
 
+func (l *List) HasMediaID(id string) bool {
+	for _, m := range l.Medias {
+		if m.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *List) TotalLength() (total int64) {
 	for _, m := range l.Medias {
 		total += m.Length
@@ -289,6 +770,42 @@ func (l *List) AddMedia(media *Media) error {
 	return l.Save()
 }
 
+// InsertMedia adds the media at position, or at the end if the list is shorter.
+func (l *List) InsertMedia(media *Media, position int) error {
+	if l.HasMedia(media) {
+		return nil
+	}
+	if position < 0 || position > len(l.Medias) {
+		position = len(l.Medias)
+	}
+	medias := append([]*Media{}, l.Medias[:position]...)
+	medias = append(medias, media)
+	l.Medias = append(medias, l.Medias[position:]...)
+	return l.Save()
+}
+
+// ReorderMedia puts the media in the order of ids, which must list each of them once.
+func (l *List) ReorderMedia(ids []string) error {
+	if len(ids) != len(l.Medias) {
+		return ErrInvalidOrder
+	}
+	byID := make(map[string]*Media)
+	for _, m := range l.Medias {
+		byID[m.ID] = m
+	}
+	var medias []*Media
+	for _, id := range ids {
+		m, ok := byID[id]
+		if !ok {
+			return ErrInvalidOrder
+		}
+		delete(byID, id)
+		medias = append(medias, m)
+	}
+	l.Medias = medias
+	return l.Save()
+}
+
 func (l *List) RemoveMedia(media *Media) error {
 	if !l.HasMedia(media) {
 		return nil
@@ -313,6 +830,33 @@ func FindList(id string) (*List, error) {
 	return &list, json.Unmarshal(b, &list)
 }
 
+// FindUserList finds a list that the user is allowed to see.
+func FindUserList(id, username string) (*List, error) {
+	list, err := FindList(id)
+	if err != nil {
+		return nil, err
+	}
+	if !list.VisibleTo(username) {
+		return nil, ErrListNotFound
+	}
+	return list, nil
+}
+
+// UserLists returns the user's own lists and the shared lists.
+func UserLists(username string) ([]*List, error) {
+	lists, err := ListLists()
+	if err != nil {
+		return nil, err
+	}
+	var filtered []*List
+	for _, l := range lists {
+		if l.VisibleTo(username) {
+			filtered = append(filtered, l)
+		}
+	}
+	return filtered, nil
+}
+
 func ListLists() ([]*List, error) {
 	files, err := ioutil.ReadDir(datadir)
 	if err != nil {
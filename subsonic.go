@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/xml"
 	"fmt"
 	"github.com/disintegration/imaging"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,7 +22,7 @@ const (
 	SubsonicXMLNS = "http://subsonic.org/restapi"
 
 	// Version is the emulated Subsonic API version
-	SubsonicVersion = "1.8.0"
+	SubsonicVersion = "1.9.0"
 )
 
 type SubsonicResponse struct {
@@ -46,6 +48,9 @@ type SubsonicResponse struct {
 	// getIndexes.view
 	Indexes *SubsonicIndexes
 
+	// getInternetRadioStations.view
+	InternetRadioStations *SubsonicInternetRadioStations
+
 	// getLicense.view
 	License *SubsonicLicense `xml:"license"`
 
@@ -69,6 +74,12 @@ type SubsonicResponse struct {
 
 	// getStarred.view
 	Starred *SubsonicStarred `xml:"starred"`
+
+	// getUser.view
+	User *SubsonicUser
+
+	// getUsers.view
+	Users *SubsonicUsers
 }
 
 // SubsonicError contains a Subsonic error, with status code and message
@@ -259,6 +270,31 @@ type SubsonicPlaylistEntry struct {
 	Suffix      string    `xml:"suffix,attr"`
 	ContentType string    `xml:"contentType,attr"`
 	Type        string    `xml:"type,attr"`
+
+	ReplayGain *SubsonicReplayGain
+}
+
+// SubsonicReplayGain represents the (OpenSubsonic) ReplayGain of a song
+type SubsonicReplayGain struct {
+	XMLName xml.Name `xml:"replayGain,omitempty"`
+
+	TrackGain float64 `xml:"trackGain,attr"`
+	TrackPeak float64 `xml:"trackPeak,attr"`
+}
+
+// SubsonicInternetRadioStations contains a list of Subsonic internet radio stations
+type SubsonicInternetRadioStations struct {
+	XMLName xml.Name `xml:"internetRadioStations,omitempty"`
+
+	Stations []SubsonicInternetRadioStation `xml:"internetRadioStation"`
+}
+
+// SubsonicInternetRadioStation represents a Subsonic internet radio station
+type SubsonicInternetRadioStation struct {
+	ID          string `xml:"id,attr"`
+	Name        string `xml:"name,attr"`
+	StreamURL   string `xml:"streamUrl,attr"`
+	HomePageURL string `xml:"homePageUrl,attr,omitempty"`
 }
 
 // SubsonicMusicFolders contains a list of emulated Subsonic music folders
@@ -275,6 +311,50 @@ type SubsonicStarred struct {
 	XMLName xml.Name `xml:"starred,omitempty"`
 }
 
+// SubsonicUsers contains a list of Subsonic users
+type SubsonicUsers struct {
+	XMLName xml.Name `xml:"users,omitempty"`
+
+	Users []SubsonicUser `xml:"user"`
+}
+
+// SubsonicUser represents a Subsonic user and their roles
+type SubsonicUser struct {
+	XMLName xml.Name `xml:"user,omitempty"`
+
+	Username          string `xml:"username,attr"`
+	Email             string `xml:"email,attr"`
+	ScrobblingEnabled bool   `xml:"scrobblingEnabled,attr"`
+	AdminRole         bool   `xml:"adminRole,attr"`
+	SettingsRole      bool   `xml:"settingsRole,attr"`
+	DownloadRole      bool   `xml:"downloadRole,attr"`
+	UploadRole        bool   `xml:"uploadRole,attr"`
+	PlaylistRole      bool   `xml:"playlistRole,attr"`
+	CoverArtRole      bool   `xml:"coverArtRole,attr"`
+	CommentRole       bool   `xml:"commentRole,attr"`
+	PodcastRole       bool   `xml:"podcastRole,attr"`
+	StreamRole        bool   `xml:"streamRole,attr"`
+	JukeboxRole       bool   `xml:"jukeboxRole,attr"`
+	ShareRole         bool   `xml:"shareRole,attr"`
+
+	Folders []int `xml:"folder"`
+}
+
+func NewSubsonicUser(u User) SubsonicUser {
+	return SubsonicUser{
+		Username:     u.Username,
+		AdminRole:    u.Admin,
+		SettingsRole: u.Admin,
+		DownloadRole: true,
+		UploadRole:   true,
+		PlaylistRole: true,
+		CoverArtRole: true,
+		PodcastRole:  true,
+		StreamRole:   true,
+		Folders:      []int{1},
+	}
+}
+
 func NewSubsonicResponse() *SubsonicResponse {
 	return &SubsonicResponse{
 		XMLNS:   SubsonicXMLNS,
@@ -283,6 +363,31 @@ func NewSubsonicResponse() *SubsonicResponse {
 	}
 }
 
+// Subsonic error codes
+const (
+	SubsonicErrorMissingParameter = 10
+	SubsonicErrorWrongCredentials = 40
+	SubsonicErrorNotAuthorized    = 50
+	SubsonicErrorNotFound         = 70
+)
+
+func subsonicFailed(w http.ResponseWriter, code int, message string) {
+	response := NewSubsonicResponse()
+	response.Status = "failed"
+	response.SubError = &SubsonicError{Code: code, Message: message}
+	XML(w, response)
+}
+
+// subsonicUser returns the authenticated user, or writes a Subsonic error.
+func subsonicUser(w http.ResponseWriter, ps httprouter.Params) (User, bool) {
+	u, err := users.Get(ps.ByName("user"))
+	if err != nil {
+		subsonicFailed(w, SubsonicErrorWrongCredentials, "Wrong username or password")
+		return User{}, false
+	}
+	return u, true
+}
+
 func subsonicPing(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	response := NewSubsonicResponse()
 	XML(w, response)
@@ -315,7 +420,7 @@ func subsonicGetIndexes(w http.ResponseWriter, r *http.Request, ps httprouter.Pa
 func subsonicGetPlaylists(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	response := NewSubsonicResponse()
 
-	lists, err := ListLists()
+	lists, err := UserLists(ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -328,8 +433,8 @@ func subsonicGetPlaylists(w http.ResponseWriter, r *http.Request, ps httprouter.
 			ID:        list.ID,
 			Name:      list.Title,
 			Comment:   list.Title,
-			Owner:     "admin",
-			Public:    false,
+			Owner:     list.Owner,
+			Public:    list.Owner == "",
 			SongCount: len(list.Medias),
 			Duration:  int(list.TotalLength()),
 		})
@@ -342,7 +447,7 @@ func subsonicGetPlaylists(w http.ResponseWriter, r *http.Request, ps httprouter.
 func subsonicGetPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	response := NewSubsonicResponse()
 
-	list, err := FindList(r.FormValue("id"))
+	list, err := FindUserList(r.FormValue("id"), ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -350,18 +455,28 @@ func subsonicGetPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.P
 
 	var entries []SubsonicPlaylistEntry
 	for _, media := range list.Medias {
+		var replayGain *SubsonicReplayGain
+		if media.HasGain() {
+			replayGain = &SubsonicReplayGain{
+				TrackGain: media.TrackGain,
+				TrackPeak: media.TrackPeak,
+			}
+		}
 		entries = append(entries, SubsonicPlaylistEntry{
 			ID:          media.ID,
 			Title:       media.Title,
+			Album:       media.Album,
+			Artist:      media.Author,
 			Duration:    int(media.Length),
 			CoverArt:    media.ID,
-			Path:        fmt.Sprintf("/soundscape/stream/%s/%s.mp3", list.ID, media.ID),
+			Path:        URL("/stream/%s/%s.mp3", list.ID, media.ID),
 			ContentType: "audio/mp3",
 			Suffix:      "mp3",
-			//Path:        fmt.Sprintf("/soundscape/stream/%s/%s.m4a", list.ID, media.ID),
+			//Path:        URL("/stream/%s/%s.m4a", list.ID, media.ID),
 			//ContentType: "audio/mp4",
 			//Suffix:      "m4a",
-			Type: "music",
+			Type:       "music",
+			ReplayGain: replayGain,
 		})
 	}
 
@@ -369,8 +484,8 @@ func subsonicGetPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.P
 		ID:        list.ID,
 		Name:      list.Title,
 		Comment:   list.Title,
-		Owner:     "admin",
-		Public:    false,
+		Owner:     list.Owner,
+		Public:    list.Owner == "",
 		SongCount: len(list.Medias),
 		Duration:  int(list.TotalLength()),
 		CoverArt:  list.ID,
@@ -380,7 +495,7 @@ func subsonicGetPlaylist(w http.ResponseWriter, r *http.Request, ps httprouter.P
 }
 
 func subsonicGetCoverArt(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	media, err := FindMedia(r.FormValue("id"))
+	media, err := FindUserMedia(r.FormValue("id"), ps.ByName("user"))
 	if err != nil {
 		Error(w, err)
 		return
@@ -412,3 +527,165 @@ func subsonicGetLyrics(w http.ResponseWriter, r *http.Request, ps httprouter.Par
 	response.Lyrics = &SubsonicLyrics{}
 	XML(w, response)
 }
+
+func subsonicGetInternetRadioStations(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	response := NewSubsonicResponse()
+
+	lists, err := UserLists(ps.ByName("user"))
+	if err != nil {
+		Error(w, err)
+		return
+	}
+
+	// Players fetch the stream themselves, without the client's credentials,
+	// so each playlist gets a radio share that only plays its station.
+	var stations []SubsonicInternetRadioStation
+	for _, list := range lists {
+		share, err := shares.Radio(ps.ByName("user"), list.ID)
+		if err != nil {
+			Error(w, err)
+			return
+		}
+		stations = append(stations, SubsonicInternetRadioStation{
+			ID:          list.ID,
+			Name:        list.Title,
+			StreamURL:   AbsoluteURL(r, "/radio/%s", share.ID),
+			HomePageURL: AbsoluteURL(r, "/play/%s", list.ID),
+		})
+	}
+
+	response.InternetRadioStations = &SubsonicInternetRadioStations{Stations: stations}
+	XML(w, response)
+}
+
+func subsonicGetUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	current, ok := subsonicUser(w, ps)
+	if !ok {
+		return
+	}
+	username := r.FormValue("username")
+	if username == "" {
+		subsonicFailed(w, SubsonicErrorMissingParameter, "Required parameter is missing: username")
+		return
+	}
+	if username != current.Username && !current.Admin {
+		subsonicFailed(w, SubsonicErrorNotAuthorized, "User is not authorized for the given operation")
+		return
+	}
+	u, err := users.Get(username)
+	if err != nil {
+		subsonicFailed(w, SubsonicErrorNotFound, err.Error())
+		return
+	}
+
+	response := NewSubsonicResponse()
+	user := NewSubsonicUser(u)
+	response.User = &user
+	XML(w, response)
+}
+
+func subsonicGetUsers(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	current, ok := subsonicUser(w, ps)
+	if !ok {
+		return
+	}
+	if !current.Admin {
+		subsonicFailed(w, SubsonicErrorNotAuthorized, "User is not authorized for the given operation")
+		return
+	}
+
+	var list []SubsonicUser
+	for _, u := range users.List() {
+		list = append(list, NewSubsonicUser(u))
+	}
+
+	response := NewSubsonicResponse()
+	response.Users = &SubsonicUsers{Users: list}
+	XML(w, response)
+}
+
+func subsonicCreateUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	current, ok := subsonicUser(w, ps)
+	if !ok {
+		return
+	}
+	if !current.Admin || !tokenAllows(ps, ScopeAdmin) {
+		subsonicFailed(w, SubsonicErrorNotAuthorized, "User is not authorized for the given operation")
+		return
+	}
+	if !checkSubsonicCSRF(r, ps) {
+		logger.Warnf("rejected %s %s by %q from %q: missing or invalid CSRF token", r.Method, r.URL.Path, current.Username, clientIP(r))
+		subsonicFailed(w, SubsonicErrorNotAuthorized, "Missing or invalid CSRF token, use the u and p parameters")
+		return
+	}
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+	if username == "" || password == "" {
+		subsonicFailed(w, SubsonicErrorMissingParameter, "Required parameter is missing: username, password")
+		return
+	}
+	if strings.HasPrefix(password, "enc:") {
+		b, err := hex.DecodeString(strings.TrimPrefix(password, "enc:"))
+		if err != nil {
+			subsonicFailed(w, SubsonicErrorMissingParameter, "Invalid password encoding")
+			return
+		}
+		password = string(b)
+	}
+	if err := ValidatePassword(password); err != nil {
+		subsonicFailed(w, SubsonicErrorMissingParameter, err.Error())
+		return
+	}
+	if _, err := users.Add(username, password, r.FormValue("adminRole") == "true"); err != nil {
+		subsonicFailed(w, SubsonicErrorMissingParameter, err.Error())
+		return
+	}
+	logger.Infof("user %q created user %q", current.Username, username)
+	audit.Record(r, ps, "create", "user", username, "via subsonic")
+	XML(w, NewSubsonicResponse())
+}
+
+func subsonicDeleteUser(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	current, ok := subsonicUser(w, ps)
+	if !ok {
+		return
+	}
+	if !current.Admin || !tokenAllows(ps, ScopeAdmin) {
+		subsonicFailed(w, SubsonicErrorNotAuthorized, "User is not authorized for the given operation")
+		return
+	}
+	if !checkSubsonicCSRF(r, ps) {
+		logger.Warnf("rejected %s %s by %q from %q: missing or invalid CSRF token", r.Method, r.URL.Path, current.Username, clientIP(r))
+		subsonicFailed(w, SubsonicErrorNotAuthorized, "Missing or invalid CSRF token, use the u and p parameters")
+		return
+	}
+	username := r.FormValue("username")
+	if username == "" {
+		subsonicFailed(w, SubsonicErrorMissingParameter, "Required parameter is missing: username")
+		return
+	}
+	if username == current.Username {
+		subsonicFailed(w, SubsonicErrorNotAuthorized, "Users can't delete themselves")
+		return
+	}
+	medias, lists, err := ReassignOwner(username, current.Username)
+	if err != nil {
+		Error(w, err)
+		return
+	}
+	if err := users.Delete(username); err != nil {
+		subsonicFailed(w, SubsonicErrorNotFound, err.Error())
+		return
+	}
+	if err := sessions.DeleteUser(username); err != nil {
+		Error(w, err)
+		return
+	}
+	if err := tokens.DeleteUser(username); err != nil {
+		Error(w, err)
+		return
+	}
+	logger.Infof("user %q deleted user %q, taking over %d media and %d playlists", current.Username, username, medias, lists)
+	audit.Record(r, ps, "delete", "user", username, fmt.Sprintf("via subsonic, %d media and %d playlists reassigned", medias, lists))
+	XML(w, NewSubsonicResponse())
+}
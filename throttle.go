@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttle limits failed logins per client IP.
+type Throttle struct {
+	mu       sync.Mutex
+	max      int
+	window   time.Duration
+	failures map[string][]time.Time
+}
+
+func NewThrottle(max int, window time.Duration) *Throttle {
+	return &Throttle{
+		max:      max,
+		window:   window,
+		failures: make(map[string][]time.Time),
+	}
+}
+
+// Allowed reports whether the client may try to log in, and if not, how long it has to wait.
+func (t *Throttle) Allowed(ip string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	failures := t.recent(ip)
+	if len(failures) < t.max {
+		return true, 0
+	}
+	return false, failures[0].Add(t.window).Sub(time.Now())
+}
+
+// Fail records a failed login.
+func (t *Throttle) Fail(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failures[ip] = append(t.recent(ip), time.Now())
+
+	// Forget clients that went away.
+	for other := range t.failures {
+		t.recent(other)
+	}
+}
+
+// Reset forgets the client's failures after a successful login.
+func (t *Throttle) Reset(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, ip)
+}
+
+// recent returns the failures within the window; the caller must hold the lock.
+func (t *Throttle) recent(ip string) []time.Time {
+	cutoff := time.Now().Add(-t.window)
+	var recent []time.Time
+	for _, f := range t.failures[ip] {
+		if f.After(cutoff) {
+			recent = append(recent, f)
+		}
+	}
+	if recent == nil {
+		delete(t.failures, ip)
+	} else {
+		t.failures[ip] = recent
+	}
+	return recent
+}
+
+// clientIP returns the IP address of the connecting client. Behind one of
+// the --trusted-proxies or the --reverse-proxy-ip it's the address the proxy
+// added last to X-Forwarded-For; the ones before it come from the client and
+// can be forged.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+	forwarded := r.Header["X-Forwarded-For"]
+	if len(forwarded) == 0 {
+		return ip
+	}
+	hops := strings.Split(forwarded[len(forwarded)-1], ",")
+	if last := strings.TrimSpace(hops[len(hops)-1]); net.ParseIP(last) != nil {
+		return last
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string) bool {
+	if reverseProxyAuthIP != "" && ip == reverseProxyAuthIP {
+		return true
+	}
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		if strings.TrimSpace(proxy) == ip {
+			return true
+		}
+	}
+	return false
+}
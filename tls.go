@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes.
+const tlsReloadInterval = 30 * time.Second
+
+// CertReloader serves a certificate from files, and reloads it when they
+// change, so renewed certificates are picked up without a restart.
+type CertReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+
+	cert     *tls.Certificate
+	modified time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{certFile: certFile, keyFile: keyFile}
+	return c, c.reload()
+}
+
+func (c *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert, nil
+}
+
+// lastModified is the newest modification time of the two files.
+func (c *CertReloader) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, filename := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(modified) {
+			modified = fi.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+func (c *CertReloader) reload() error {
+	modified, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if len(cert.Certificate) > 0 {
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			cert.Leaf = leaf
+			logger.Infof("tls: loaded certificate for %v, expires %s", leaf.DNSNames, leaf.NotAfter.Format("2006-01-02"))
+		}
+	}
+
+	c.Lock()
+	c.cert = &cert
+	c.modified = modified
+	c.Unlock()
+	return nil
+}
+
+// Watch reloads the certificate when the files change, forever. A broken
+// certificate (e.g. the key was written but not the certificate yet) is
+// logged and the previous one is kept.
+func (c *CertReloader) Watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+
+		modified, err := c.lastModified()
+		if err != nil {
+			logger.Errorf("tls: checking certificate failed: %s", err)
+			continue
+		}
+		c.RLock()
+		changed := modified.After(c.modified)
+		c.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := c.reload(); err != nil {
+			logger.Errorf("tls: reloading certificate failed, keeping the previous one: %s", err)
+		}
+	}
+}
+
+// acmeHTTPClient is the client for talking to the ACME directory, trusting
+// the extra CA certificate in caFile (e.g. Pebble's) if it's set.
+func acmeHTTPClient(caFile string) (*http.Client, error) {
+	if caFile == "" {
+		return http.DefaultClient, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %q", caFile)
+	}
+	return &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}, nil
+}
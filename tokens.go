@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token scopes. Admin allows everything the user can do. Metrics only
+// allows scraping /metrics, so a Prometheus server doesn't need an admin token.
+const (
+	ScopeRead     = "read"
+	ScopeImport   = "import"
+	ScopePlaylist = "playlist-edit"
+	ScopeMetrics  = "metrics"
+	ScopeAdmin    = "admin"
+
+	tokenPrefix = "sst_"
+
+	// How often the last used time is written to disk.
+	tokenUsedInterval = time.Minute
+)
+
+var (
+	Scopes = []string{ScopeRead, ScopeImport, ScopePlaylist, ScopeMetrics, ScopeAdmin}
+
+	ErrTokenNotFound = errors.New("token not found")
+	ErrInvalidScope  = errors.New("invalid scope")
+)
+
+type Token struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Username string    `json:"username"`
+	Scopes   []string  `json:"scopes"`
+	Hash     string    `json:"hash"` // sha256 of the secret
+	Created  time.Time `json:"created"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Allows reports whether the token grants scope.
+func (t Token) Allows(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens are personal API tokens, persisted as a single JSON file.
+type Tokens struct {
+	sync.RWMutex
+	saving   sync.Mutex // one Save at a time, so an older snapshot can't overwrite a newer one
+	filename string
+
+	Tokens map[string]*Token `json:"tokens"`
+}
+
+func NewTokens(filename string) (*Tokens, error) {
+	filename = filepath.Join(datadir, filename)
+	s := &Tokens{
+		filename: filename,
+		Tokens:   make(map[string]*Token),
+	}
+	b, err := ioutil.ReadFile(filename)
+
+	// Default for new store
+	if os.IsNotExist(err) {
+		return s, s.Save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Open existing store
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Tokens == nil {
+		s.Tokens = make(map[string]*Token)
+	}
+	return s, nil
+}
+
+// Create makes a new token for the user, returning it and its secret.
+// The secret is only stored hashed, so this is the only chance to see it.
+func (s *Tokens) Create(username, name string, scopes []string) (Token, string, error) {
+	if len(scopes) == 0 {
+		return Token{}, "", ErrInvalidScope
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return Token{}, "", ErrInvalidScope
+		}
+	}
+	id, err := RandomString(6)
+	if err != nil {
+		return Token{}, "", err
+	}
+	random, err := RandomString(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret := tokenPrefix + id + "_" + random
+
+	t := &Token{
+		ID:       id,
+		Name:     name,
+		Username: username,
+		Scopes:   scopes,
+		Hash:     hashToken(secret),
+		Created:  time.Now(),
+	}
+	s.Lock()
+	s.Tokens[id] = t
+	s.Unlock()
+	return *t, secret, s.Save()
+}
+
+// Authenticate returns the token for secret, recording that it was used.
+func (s *Tokens) Authenticate(secret string) (Token, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(secret, tokenPrefix), "_", 2)
+	if !strings.HasPrefix(secret, tokenPrefix) || len(parts) != 2 {
+		return Token{}, false
+	}
+
+	s.Lock()
+	t, ok := s.Tokens[parts[0]]
+	if !ok || t.Hash != hashToken(secret) {
+		s.Unlock()
+		return Token{}, false
+	}
+	save := time.Since(t.LastUsed) > tokenUsedInterval
+	t.LastUsed = time.Now()
+	token := *t
+	s.Unlock()
+
+	if save {
+		if err := s.Save(); err != nil {
+			logger.Error(err)
+		}
+	}
+	return token, true
+}
+
+// List returns copies of the user's tokens, newest first.
+func (s *Tokens) List(username string) []Token {
+	s.RLock()
+	defer s.RUnlock()
+	var tokens []Token
+	for _, t := range s.Tokens {
+		if t.Username == username {
+			tokens = append(tokens, *t)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.After(tokens[j].Created)
+	})
+	return tokens
+}
+
+// Revoke deletes one of the user's tokens.
+func (s *Tokens) Revoke(username, id string) error {
+	s.Lock()
+	t, ok := s.Tokens[id]
+	if !ok || t.Username != username {
+		s.Unlock()
+		return ErrTokenNotFound
+	}
+	delete(s.Tokens, id)
+	s.Unlock()
+	return s.Save()
+}
+
+// DeleteUser revokes all of a user's tokens.
+func (s *Tokens) DeleteUser(username string) error {
+	s.Lock()
+	for id, t := range s.Tokens {
+		if t.Username == username {
+			delete(s.Tokens, id)
+		}
+	}
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *Tokens) Save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	s.RLock()
+	b, err := json.MarshalIndent(s, "", "    ")
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+	return Overwrite(s.filename, b, 0600)
+}
+
+func validScope(scope string) bool {
+	for _, s := range Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
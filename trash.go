@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	ErrTrashNotFound = errors.New("trash item not found")
+	ErrTrashConflict = errors.New("an item with the same id exists, delete it first")
+)
+
+// How often the purger looks for expired trash.
+const trashPurgeInterval = time.Hour
+
+// TrashItem is a deleted media or playlist, kept in its own directory under
+// the trash until it's restored or purged.
+type TrashItem struct {
+	ID        string    `json:"id"`
+	Media     *Media    `json:"media,omitempty"`
+	List      *List     `json:"list,omitempty"`
+	DeletedBy string    `json:"deleted_by"`
+	Deleted   time.Time `json:"deleted"`
+
+	// The playlists the media was in, and where, so restoring puts it back.
+	Memberships []TrashMembership `json:"memberships,omitempty"`
+
+	// The shares that were revoked by the deletion.
+	Shares []Share `json:"shares,omitempty"`
+}
+
+type TrashMembership struct {
+	ListID   string `json:"list_id"`
+	Position int    `json:"position"`
+}
+
+func trashDir() string {
+	return filepath.Join(datadir, ".trash")
+}
+
+func (t TrashItem) Dir() string {
+	return filepath.Join(trashDir(), t.ID)
+}
+
+func (t TrashItem) file() string {
+	return filepath.Join(t.Dir(), "trash.json")
+}
+
+func (t TrashItem) Kind() string {
+	if t.Media != nil {
+		return "media"
+	}
+	return "list"
+}
+
+func (t TrashItem) Title() string {
+	if t.Media != nil {
+		return t.Media.Title
+	}
+	return t.List.Title
+}
+
+func (t TrashItem) Owner() string {
+	if t.Media != nil {
+		return t.Media.Owner
+	}
+	return t.List.Owner
+}
+
+// Expires is when the purger removes the item for good.
+func (t TrashItem) Expires() time.Time {
+	return t.Deleted.Add(TrashRetention())
+}
+
+// VisibleTo reports whether the user may restore or purge the item.
+func (t TrashItem) VisibleTo(u User) bool {
+	return u.Admin || t.DeletedBy == u.Username || (t.Owner() != "" && t.Owner() == u.Username)
+}
+
+func (t TrashItem) save() error {
+	b, err := json.MarshalIndent(t, "", "    ")
+	if err != nil {
+		return err
+	}
+	return Overwrite(t.file(), b, 0600)
+}
+
+// trashFiles moves the files that exist into the item's directory and saves
+// the item. If that fails, the files are moved back and the item is removed.
+func (t TrashItem) trashFiles(files []string) (err error) {
+	var moved []string
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, f := range moved {
+			if rerr := os.Rename(filepath.Join(t.Dir(), filepath.Base(f)), f); rerr != nil {
+				logger.Errorf("moving %q back out of the trash failed: %s", f, rerr)
+				return
+			}
+		}
+		os.RemoveAll(t.Dir())
+	}()
+	for _, f := range files {
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Rename(f, filepath.Join(t.Dir(), filepath.Base(f))); err != nil {
+			return err
+		}
+		moved = append(moved, f)
+	}
+	return t.save()
+}
+
+func newTrashItem(kind, id, deletedBy string) (TrashItem, error) {
+	t := TrashItem{
+		ID:        fmt.Sprintf("%s-%s-%d", kind, id, time.Now().UnixNano()),
+		DeletedBy: deletedBy,
+		Deleted:   time.Now(),
+	}
+	return t, os.MkdirAll(t.Dir(), 0755)
+}
+
+// TrashMedia moves the media's files into the trash, remembering its playlists and shares.
+func TrashMedia(media *Media, memberships []TrashMembership, revoked []Share, deletedBy string) (TrashItem, error) {
+	t, err := newTrashItem("media", media.ID, deletedBy)
+	if err != nil {
+		return t, err
+	}
+	t.Media = media
+	t.Memberships = memberships
+	t.Shares = revoked
+	if err := t.trashFiles([]string{
+		media.ImageFile(),
+		media.VideoFile(),
+		media.AudioFile(),
+		media.SourceFile(),
+		media.File(),
+	}); err != nil {
+		return t, err
+	}
+
+	// The HLS segments are only a cache, made again if it's restored and played.
+	if err := os.RemoveAll(media.HLSDir()); err != nil {
+		logger.Warnf("removing the HLS segments of media %q failed: %s", media.ID, err)
+	}
+	return t, nil
+}
+
+// TrashList moves the playlist into the trash, with its shares.
+func TrashList(list *List, revoked []Share, deletedBy string) (TrashItem, error) {
+	t, err := newTrashItem("list", list.ID, deletedBy)
+	if err != nil {
+		return t, err
+	}
+	t.List = list
+	t.Shares = revoked
+	return t, t.trashFiles([]string{list.File()})
+}
+
+// ListTrash returns the trash, most recently deleted first.
+func ListTrash() ([]TrashItem, error) {
+	dirs, err := ioutil.ReadDir(trashDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []TrashItem
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		t, err := FindTrash(d.Name())
+		if err != nil {
+			logger.Errorf("trash: skipping %q: %s", d.Name(), err)
+			continue
+		}
+		items = append(items, t)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Deleted.After(items[j].Deleted)
+	})
+	return items, nil
+}
+
+func FindTrash(id string) (TrashItem, error) {
+	if id == "" || id != filepath.Base(id) || id[0] == '.' {
+		return TrashItem{}, ErrTrashNotFound
+	}
+	b, err := ioutil.ReadFile(TrashItem{ID: id}.file())
+	if os.IsNotExist(err) {
+		return TrashItem{}, ErrTrashNotFound
+	}
+	if err != nil {
+		return TrashItem{}, err
+	}
+	var t TrashItem
+	if err := json.Unmarshal(b, &t); err != nil {
+		return TrashItem{}, err
+	}
+	if t.Media == nil && t.List == nil {
+		return TrashItem{}, fmt.Errorf("trash item %q is empty", id)
+	}
+	return t, nil
+}
+
+// Restore moves the item back into the library, puts media back into the
+// playlists that still exist and brings back the revoked shares.
+func (t TrashItem) Restore() error {
+	files, err := ioutil.ReadDir(t.Dir())
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.Name() == "trash.json" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(datadir, f.Name())); err == nil {
+			return ErrTrashConflict
+		}
+	}
+	for _, f := range files {
+		if f.Name() == "trash.json" {
+			continue
+		}
+		if err := os.Rename(filepath.Join(t.Dir(), f.Name()), filepath.Join(datadir, f.Name())); err != nil {
+			return err
+		}
+	}
+
+	if t.Media != nil {
+		for _, m := range t.Memberships {
+			list, err := FindList(m.ListID)
+			if err != nil {
+				continue
+			}
+			if err := list.InsertMedia(t.Media, m.Position); err != nil {
+				return err
+			}
+		}
+	}
+	if err := shares.Restore(t.Shares); err != nil {
+		return err
+	}
+	return os.RemoveAll(t.Dir())
+}
+
+// Purge deletes the item for good.
+func (t TrashItem) Purge() error {
+	return os.RemoveAll(t.Dir())
+}
+
+// PurgeTrash deletes the items that have been in the trash longer than the retention period.
+func PurgeTrash() error {
+	items, err := ListTrash()
+	if err != nil {
+		return err
+	}
+	for _, t := range items {
+		if time.Now().Before(t.Expires()) {
+			continue
+		}
+		if err := t.Purge(); err != nil {
+			return err
+		}
+		logger.Infof("trash: purged %s %q %q deleted by %q on %s", t.Kind(), t.ID, t.Title(), t.DeletedBy, t.Deleted.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// Purger empties expired trash now and then, forever.
+func Purger() {
+	for {
+		if err := PurgeTrash(); err != nil {
+			logger.Errorf("trash: purging failed: %s", err)
+		}
+		time.Sleep(trashPurgeInterval)
+	}
+}
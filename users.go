@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserNotFound    = errors.New("user not found")
+	ErrUserExists      = errors.New("user already exists")
+	ErrInvalidUsername = errors.New("invalid username")
+	ErrInvalidPassword = errors.New("password must be at least 8 characters")
+	ErrNotLinked       = errors.New("an account with this name already exists; log in with its password and link it to SSO on the account page")
+	ErrAlreadyLinked   = errors.New("this SSO login is already linked to another account")
+
+	usernameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._@-]{0,63}$`)
+
+	// How long a verified password is remembered, to avoid running bcrypt on every request.
+	verifiedTTL = 10 * time.Minute
+)
+
+type User struct {
+	Username string    `json:"username"`
+	Password string    `json:"password"` // bcrypt hash
+	Admin    bool      `json:"admin"`
+	Created  time.Time `json:"created"`
+
+	// SSO is the issuer and subject of the OpenID Connect login linked to
+	// the account, which is how the account is found when they log in.
+	SSO string `json:"sso,omitempty"`
+}
+
+// SSOIdentity identifies an OpenID Connect login. The username at the
+// provider can change, and anyone may be able to choose it.
+func SSOIdentity(issuer, subject string) string {
+	return issuer + " " + subject
+}
+
+// ValidatePassword checks a new password chosen by a user.
+func ValidatePassword(password string) error {
+	if len(password) < 8 {
+		return ErrInvalidPassword
+	}
+	return nil
+}
+
+func (u User) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) == nil
+}
+
+// Users is the account store, persisted as a single JSON file.
+type Users struct {
+	sync.RWMutex
+	saving   sync.Mutex // one Save at a time, so an older snapshot can't overwrite a newer one
+	filename string
+	verified map[string]time.Time
+
+	Users map[string]*User `json:"users"`
+}
+
+func NewUsers(filename string) (*Users, error) {
+	filename = filepath.Join(datadir, filename)
+	s := &Users{
+		filename: filename,
+		verified: make(map[string]time.Time),
+		Users:    make(map[string]*User),
+	}
+	b, err := ioutil.ReadFile(filename)
+
+	// Default for new store
+	if os.IsNotExist(err) {
+		return s, s.Save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Open existing store
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Users == nil {
+		s.Users = make(map[string]*User)
+	}
+	return s, nil
+}
+
+func (s *Users) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.Users)
+}
+
+// Get returns a copy of the user.
+func (s *Users) Get(username string) (User, error) {
+	s.RLock()
+	defer s.RUnlock()
+	u, ok := s.Users[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return *u, nil
+}
+
+// List returns copies of all users, sorted by username.
+func (s *Users) List() []User {
+	s.RLock()
+	defer s.RUnlock()
+	var users []User
+	for _, u := range s.Users {
+		users = append(users, *u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Username < users[j].Username
+	})
+	return users
+}
+
+func (s *Users) Add(username, password string, admin bool) (User, error) {
+	if !usernameRegexp.MatchString(username) {
+		return User{}, ErrInvalidUsername
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	s.Lock()
+	if _, ok := s.Users[username]; ok {
+		s.Unlock()
+		return User{}, ErrUserExists
+	}
+	u := &User{
+		Username: username,
+		Password: string(hash),
+		Admin:    admin,
+		Created:  time.Now(),
+	}
+	s.Users[username] = u
+	s.Unlock()
+	return *u, s.Save()
+}
+
+// Provision returns the user, creating it without a usable password if it
+// doesn't exist (for users authenticated elsewhere, such as a reverse proxy).
+// The first user is made an admin.
+func (s *Users) Provision(username string) (User, error) {
+	if u, err := s.Get(username); err == nil {
+		return u, nil
+	}
+	password, err := RandomString(32)
+	if err != nil {
+		return User{}, err
+	}
+	u, err := s.Add(username, password, s.Len() == 0)
+	if err == ErrUserExists {
+		return s.Get(username)
+	}
+	if err == nil {
+		logger.Infof("provisioned user %q (admin: %t)", u.Username, u.Admin)
+	}
+	return u, err
+}
+
+// ProvisionSSO returns the user linked to the SSO identity, creating it
+// as username if there isn't one. An existing account with the same name
+// is never used: it has to be linked first by someone who can log in to it.
+func (s *Users) ProvisionSSO(identity, username string) (User, error) {
+	s.RLock()
+	for _, u := range s.Users {
+		if u.SSO == identity {
+			s.RUnlock()
+			return *u, nil
+		}
+	}
+	s.RUnlock()
+
+	if !usernameRegexp.MatchString(username) {
+		return User{}, ErrInvalidUsername
+	}
+	password, err := RandomString(32)
+	if err != nil {
+		return User{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+
+	s.Lock()
+	for _, u := range s.Users {
+		if u.SSO == identity {
+			s.Unlock()
+			return *u, nil
+		}
+	}
+	if _, ok := s.Users[username]; ok {
+		s.Unlock()
+		return User{}, ErrNotLinked
+	}
+	u := &User{
+		Username: username,
+		Password: string(hash),
+		Created:  time.Now(),
+		SSO:      identity,
+	}
+	s.Users[username] = u
+	s.Unlock()
+	logger.Infof("provisioned sso user %q (%s)", u.Username, identity)
+	return *u, s.Save()
+}
+
+// LinkSSO links the user to an SSO identity, so they can log in with it.
+func (s *Users) LinkSSO(username, identity string) error {
+	s.Lock()
+	u, ok := s.Users[username]
+	if !ok {
+		s.Unlock()
+		return ErrUserNotFound
+	}
+	for _, other := range s.Users {
+		if other.SSO == identity && other != u {
+			s.Unlock()
+			return ErrAlreadyLinked
+		}
+	}
+	u.SSO = identity
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *Users) Delete(username string) error {
+	s.Lock()
+	if _, ok := s.Users[username]; !ok {
+		s.Unlock()
+		return ErrUserNotFound
+	}
+	delete(s.Users, username)
+	s.forget()
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *Users) SetPassword(username, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	u, ok := s.Users[username]
+	if !ok {
+		s.Unlock()
+		return ErrUserNotFound
+	}
+	u.Password = string(hash)
+	s.forget()
+	s.Unlock()
+	return s.Save()
+}
+
+func (s *Users) SetAdmin(username string, admin bool) error {
+	s.Lock()
+	u, ok := s.Users[username]
+	if !ok {
+		s.Unlock()
+		return ErrUserNotFound
+	}
+	u.Admin = admin
+	s.Unlock()
+	return s.Save()
+}
+
+// Authenticate checks a username and password.
+func (s *Users) Authenticate(username, password string) (User, bool) {
+	u, err := s.Get(username)
+	if err != nil {
+		return User{}, false
+	}
+
+	sum := sha256.Sum256([]byte(username + "\x00" + password))
+	key := hex.EncodeToString(sum[:])
+
+	s.RLock()
+	expires, ok := s.verified[key]
+	s.RUnlock()
+	if ok && time.Now().Before(expires) {
+		return u, true
+	}
+
+	if !u.CheckPassword(password) {
+		return User{}, false
+	}
+
+	s.Lock()
+	s.verified[key] = time.Now().Add(verifiedTTL)
+	s.Unlock()
+	return u, true
+}
+
+// forget drops all remembered passwords; the caller must hold the lock.
+func (s *Users) forget() {
+	s.verified = make(map[string]time.Time)
+}
+
+func (s *Users) Save() error {
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	s.RLock()
+	b, err := json.MarshalIndent(s, "", "    ")
+	s.RUnlock()
+	if err != nil {
+		return err
+	}
+	return Overwrite(s.filename, b, 0600)
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"strings"
 	"syscall"
 )
 
@@ -50,6 +50,15 @@ func RandomNumber() (int, error) {
 	return int(binary.LittleEndian.Uint32(b)), nil
 }
 
+// RandomString returns n random bytes, URL-safe base64 encoded.
+func RandomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 func Overwrite(filename string, data []byte, perm os.FileMode) error {
 	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
 	if err != nil {
@@ -70,50 +79,10 @@ func Overwrite(filename string, data []byte, perm os.FileMode) error {
 	return os.Rename(f.Name(), filename)
 }
 
-// Secret generates a random value and stores it in a file for persistent access.
-type Secret struct {
-	filename string
-}
-
-// NewSecret tries to create the secret file and return the Secret.
-func NewSecret(filename string) *Secret {
-	s := &Secret{filename: filename}
-	s.Get()
-	return s
-}
-
-// Get returns the secret, creating it if necessary.
-func (s Secret) Get() string {
-	// Write the value if it doesn't exist already.
-	if _, err := os.Stat(s.filename); os.IsNotExist(err) {
-		if err := s.Reset(); err != nil {
-			panic(err)
-		}
-	}
-	// Read the value that must exist now.
-	value, err := ioutil.ReadFile(s.filename)
-	if err != nil {
-		panic(err)
-	}
-	return strings.TrimSpace(string(value))
-}
-
-// Reset generates and writes a new secret to the file.
-func (s Secret) Reset() error {
-	n, err := RandomNumber()
-	if err != nil {
-		return err
-	}
-	content := []byte(fmt.Sprintf("%d\n", n))
-
-	tmpfile, err := ioutil.TempFile(filepath.Dir(s.filename), ".tmpsecret")
+func CopyFile(src, dst string) error {
+	b, err := ioutil.ReadFile(src)
 	if err != nil {
 		return err
 	}
-	defer os.Remove(tmpfile.Name())
-
-	if _, err := tmpfile.Write(content); err != nil {
-		return err
-	}
-	return os.Rename(tmpfile.Name(), s.filename)
+	return Overwrite(dst, b, 0644)
 }
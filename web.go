@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"html/template"
 	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -39,6 +44,7 @@ var (
 			return humanize.Bytes(uint64(n))
 		},
 		"time": humanize.Time,
+		"url":  URL,
 		"duration": func(seconds int64) string {
 			hours := seconds / 3600
 			seconds -= hours * 3600
@@ -58,16 +64,31 @@ var (
                 <title>Error</title>
             </head>
             <body>
-                <h2 style="color: orangered;">An error has occurred. <a href="/soundscape/logs">Check the logs</a></h2>
+                <h2 style="color: orangered;">An error has occurred. <a href="%s">Check the logs</a></h2>
             </body>
         </html>
     `
 )
 
+// URL returns the path of a page under the HTTP prefix, e.g. URL("/play/%s", id).
+// Everything that links to Soundscape uses it, so it works at any prefix.
+func URL(format string, a ...interface{}) string {
+	return httpPrefix + fmt.Sprintf(format, a...)
+}
+
+// AbsoluteURL is URL with the scheme and host, for links used outside the
+// browser (feeds, playlists and API responses). It assumes HTTPS unless the
+// reverse proxy says otherwise.
+func AbsoluteURL(r *http.Request, format string, a ...interface{}) string {
+	proto := "https"
+	if r.Header.Get("X-Forwarded-Proto") == "http" {
+		proto = "http"
+	}
+	return fmt.Sprintf("%s://%s%s", proto, httpHost, URL(format, a...))
+}
+
 func Redirect(w http.ResponseWriter, r *http.Request, format string, a ...interface{}) {
-	location := httpPrefix
-	location += fmt.Sprintf(format, a...)
-	http.Redirect(w, r, location, http.StatusFound)
+	http.Redirect(w, r, URL(format, a...), http.StatusFound)
 }
 
 func Error(w http.ResponseWriter, err error) {
@@ -75,43 +96,247 @@ func Error(w http.ResponseWriter, err error) {
 
 	w.WriteHeader(http.StatusInternalServerError)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	fmt.Fprintf(w, errorPageHTML)
+	fmt.Fprintf(w, errorPageHTML, template.HTMLEscapeString(URL("/logs")))
 }
 
+// httpError replies with the status's text, or an error object for the JSON API.
+func httpError(w http.ResponseWriter, r *http.Request, status int) {
+	if isAPI(r) {
+		apiError(w, status, "%s", http.StatusText(status))
+		return
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// Prefix returns a route pattern under the HTTP prefix.
 func Prefix(path string) string {
 	return httpPrefix + path
 }
 
+// requestInfo is what the access log learns about a request while it's handled.
+type requestInfo struct {
+	id   string
+	user string
+}
+
+type requestInfoKey struct{}
+
+// A request ID set by a reverse proxy is kept if it looks like one, so the logs can be matched up.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); validRequestID.MatchString(id) {
+		return id
+	}
+	id, err := RandomString(12)
+	if err != nil {
+		return ""
+	}
+	return id
+}
+
+// RequestID returns the ID the request is logged with.
+func RequestID(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.id
+	}
+	return ""
+}
+
+// recordUser tells the access log who made the request, once Auth knows.
+func recordUser(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.user = ps.ByName("user")
+		}
+		h(w, r, ps)
+	}
+}
+
 func Log(h httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		// Request info
-		addr := r.RemoteAddr
-		xff := r.Header.Get("X-Forwarded-For")
-		realip := r.Header.Get("X-Real-IP")
-		method := r.Method
-		rang := r.Header.Get("Range")
-		path := r.RequestURI
+		info := &requestInfo{id: newRequestID(r)}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		w.Header().Set("X-Request-ID", info.id)
+
+		route := routePattern(r, ps)
 
 		// Run the handler
 		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h(sw, r, ps)
+		elapsed := time.Since(start)
+
+		httpRequests.Inc(route, r.Method, strconv.Itoa(sw.Status()))
+		httpDuration.Observe(elapsed.Seconds(), route, r.Method)
+
+		accessLog.Infow("request",
+			"request_id", info.id,
+			"user", info.user,
+			"remote_addr", r.RemoteAddr,
+			"x_forwarded_for", r.Header.Get("X-Forwarded-For"),
+			"x_real_ip", r.Header.Get("X-Real-IP"),
+			"method", r.Method,
+			"path", redactedURI(r.URL),
+			"range", r.Header.Get("Range"),
+			"status", sw.Status(),
+			"bytes", sw.bytes,
+			"content_type", w.Header().Get("Content-Type"),
+			"duration_ms", int64(elapsed/time.Millisecond),
+		)
+	}
+}
+
+// redactedParams hold credentials: Subsonic passwords and tokens, new
+// users' passwords, and OpenID Connect authorization codes.
+var redactedParams = []string{"code", "p", "password", "s", "t"}
+
+// redactedURI is the request URI for the logs, without credentials.
+func redactedURI(u *url.URL) string {
+	q := u.Query()
+	redacted := false
+	for _, name := range redactedParams {
+		if _, ok := q[name]; ok {
+			q.Set(name, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.RequestURI()
+}
+
+// authenticate checks the session cookie, then any credentials sent with the
+// request (for podcast and Subsonic clients that can't log in).
+func authenticate(r *http.Request) (User, bool) {
+	if session, err := sessions.Get(r); err == nil {
+		if u, err := users.Get(session.Username); err == nil {
+			return u, true
+		}
+	}
+
+	username, password, ok := credentials(r)
+	if !ok {
+		return User{}, false
+	}
+	ip := clientIP(r)
+	if allowed, _ := throttle.Allowed(ip); !allowed {
+		return User{}, false
+	}
+	u, ok := users.Authenticate(username, password)
+	if !ok {
+		logger.Errorf("auth failed: client %q user %q", ip, username)
+		throttle.Fail(ip)
+		return User{}, false
+	}
+	return u, true
+}
+
+// credentials returns the basic auth credentials, or the "u" and "p"
+// parameters used by Subsonic clients.
+func credentials(r *http.Request) (string, string, bool) {
+	if user, password, ok := r.BasicAuth(); ok {
+		return user, password, true
+	}
+	if !strings.HasPrefix(r.URL.Path, Prefix("/rest/")) {
+		return "", "", false
+	}
+	user := r.FormValue("u")
+	password := r.FormValue("p")
+	if user == "" {
+		return "", "", false
+	}
+	if strings.HasPrefix(password, "enc:") {
+		b, err := hex.DecodeString(strings.TrimPrefix(password, "enc:"))
+		if err != nil {
+			return "", "", false
+		}
+		password = string(b)
+	}
+	return user, password, true
+}
+
+// Scope sets the token scope a route needs; it must wrap Auth. Without it,
+// tokens need the read scope for GET requests and the admin scope otherwise.
+func Scope(scope string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		ps = append(ps, httprouter.Param{Key: "scope", Value: scope})
 		h(w, r, ps)
-		elapsed := int64(time.Since(start) / time.Millisecond)
+	}
+}
+
+// bearerToken returns the API token sent in the Authorization header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+}
 
-		// Response info
-		mime := w.Header().Get("Content-Type")
-		logger.Infof("%q %q %q %q %q %q %q %d ms", addr, xff, realip, method, path, rang, mime, elapsed)
+// tokenAllows reports whether the request's token (if any) grants scope.
+func tokenAllows(ps httprouter.Params, scope string) bool {
+	if ps.ByName("token") == "" {
+		return true
+	}
+	for _, s := range strings.Fields(ps.ByName("scopes")) {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
 	}
+	return false
 }
 
 func Auth(h httprouter.Handle, optional bool) httprouter.Handle {
+	h = recordUser(h)
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		user := ""
 
-		// Method: Basic Auth (if we're not behind a reverse proxy, use basic auth)
-		if authsecret != nil {
-			user, password, _ := r.BasicAuth()
-			if user == httpUsername && password == authsecret.Get() {
-				ps = append(ps, httprouter.Param{Key: "user", Value: user})
+		// Method: API token (works behind a reverse proxy too, if it passes the header)
+		if secret := bearerToken(r); secret != "" {
+			t, ok := tokens.Authenticate(secret)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				httpError(w, r, http.StatusUnauthorized)
+				return
+			}
+			if _, err := users.Get(t.Username); err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				httpError(w, r, http.StatusUnauthorized)
+				return
+			}
+			scope := ps.ByName("scope")
+			if scope == "" {
+				scope = ScopeAdmin
+				if r.Method == "GET" || r.Method == "HEAD" {
+					scope = ScopeRead
+				}
+			}
+			if !t.Allows(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				httpError(w, r, http.StatusForbidden)
+				return
+			}
+			ps = append(ps,
+				httprouter.Param{Key: "user", Value: t.Username},
+				httprouter.Param{Key: "token", Value: t.ID},
+				httprouter.Param{Key: "scopes", Value: strings.Join(t.Scopes, " ")},
+			)
+			h(w, r, ps)
+			return
+		}
+
+		// Method: Login (if we're not behind a reverse proxy, use our own accounts)
+		if reverseProxyAuthIP == "" {
+			if u, ok := authenticate(r); ok {
+				if !checkCSRF(r, u.Username) {
+					csrfError(w, r, u.Username)
+					return
+				}
+				ps = append(ps, httprouter.Param{Key: "user", Value: u.Username})
 				h(w, r, ps)
 				return
 			}
@@ -119,8 +344,13 @@ func Auth(h httprouter.Handle, optional bool) httprouter.Handle {
 				h(w, r, ps)
 				return
 			}
-			w.Header().Set("WWW-Authenticate", `Basic realm="Sign-in Required"`)
-			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			// API clients get a challenge, browsers get the login page.
+			if strings.HasPrefix(r.URL.Path, Prefix("/rest/")) || isAPI(r) || r.Header.Get("Authorization") != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="Sign-in Required"`)
+				httpError(w, r, http.StatusUnauthorized)
+				return
+			}
+			Redirect(w, r, "/login?next=%s", url.QueryEscape(r.URL.RequestURI()))
 			return
 		}
 
@@ -138,6 +368,10 @@ func Auth(h httprouter.Handle, optional bool) httprouter.Handle {
 
 		if user == "" && !optional {
 			logger.Errorf("auth failed: client %q", clientIP)
+			if isAPI(r) {
+				httpError(w, r, http.StatusUnauthorized)
+				return
+			}
 			if backlink != "" {
 				http.Redirect(w, r, backlink, http.StatusFound)
 				return
@@ -146,14 +380,59 @@ func Auth(h httprouter.Handle, optional bool) httprouter.Handle {
 			return
 		}
 
-		// Add "user" to params.
+		// Add "user" to params, creating the account on first sight.
 		if user != "" {
+			if !checkCSRF(r, user) {
+				csrfError(w, r, user)
+				return
+			}
+			if _, err := users.Provision(user); err != nil {
+				Error(w, err)
+				return
+			}
 			ps = append(ps, httprouter.Param{Key: "user", Value: user})
 		}
 		h(w, r, ps)
 	}
 }
 
+// Admin only lets admin users through. It must be wrapped by Auth.
+func Admin(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		u, err := users.Get(ps.ByName("user"))
+		if err != nil || !u.Admin || !tokenAllows(ps, ScopeAdmin) {
+			httpError(w, r, http.StatusForbidden)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
+// ShareAuth is Auth for the routes that open a share by the key in param.
+// Feed clients send the share's password with basic auth, so it's checked
+// first, and isn't taken for a user's failed login.
+func ShareAuth(param string, h httprouter.Handle) httprouter.Handle {
+	auth := Auth(h, true)
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		share, err := shares.Find(ps.ByName(param))
+		_, password, basic := r.BasicAuth()
+		if err != nil || !basic || !share.HasPassword() {
+			auth(w, r, ps)
+			return
+		}
+		ip := clientIP(r)
+		if allowed, _ := throttle.Allowed(ip); !allowed || !share.CheckPassword(password) {
+			if allowed {
+				throttle.Fail(ip)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="Password Required"`)
+			httpError(w, r, http.StatusUnauthorized)
+			return
+		}
+		h(w, r, ps)
+	}
+}
+
 func XML(w http.ResponseWriter, data interface{}) {
 	w.Header().Set("Content-Type", "text/xml")
 	fmt.Fprintf(w, xml.Header)
@@ -201,6 +480,11 @@ func HTML(w http.ResponseWriter, target string, data interface{}) {
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	nonce := ""
+	if res, ok := data.(*Response); ok {
+		nonce = res.Nonce
+	}
+	securityHeaders(w, nonce)
 	if err := t.Execute(w, data); err != nil {
 		Error(w, err)
 		return